@@ -1,25 +1,38 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
-	"log"
+	"fmt"
+	"path/filepath"
 
 	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/ristretto/z"
 )
 
 type badgerstorage struct {
 	memberdb *badger.DB
 	moviedb  *badger.DB
+	cfg      config
+	// number of goroutines reading the members in full scans
+	parallelism int
+	// how full scans read the members, "iterator" to split the keys into a range per
+	// goroutine like pebble or "stream" to use badger's Stream framework
+	scan string
 }
 
 // May require increasing ulimit: `ulimit -n -S 65536` should be enough
-func newBadger() (*badgerstorage, error) {
-	memberdb, err := badger.Open(badger.DefaultOptions("badger_members"))
+func newBadger(cfg config, parallelism int, scan string) (*badgerstorage, error) {
+	if scan != "iterator" && scan != "stream" {
+		return nil, fmt.Errorf("unknown badger scan %q", scan)
+	}
+	memberdb, err := badger.Open(badger.DefaultOptions(filepath.Join(cfg.dir, "badger_members")))
 	if err != nil {
 		return nil, err
 	}
-	moviedb, err := badger.Open(badger.DefaultOptions("badger_movies"))
-	return &badgerstorage{memberdb, moviedb}, err
+	moviedb, err := badger.Open(badger.DefaultOptions(filepath.Join(cfg.dir, "badger_movies")))
+	return &badgerstorage{memberdb, moviedb, cfg, parallelism, scan}, err
 }
 
 func (s *badgerstorage) name() string {
@@ -27,94 +40,237 @@ func (s *badgerstorage) name() string {
 }
 
 func (s *badgerstorage) query(memberids []uint32, movieids []uint32) ([]output, error) {
-	capacity := len(memberids) * len(movieids)
-	vs := make([]output, 0, capacity)
-	ch := make(chan output)
-	for _, movie := range movieids {
-		go func(movie uint32) {
-			for _, member := range memberids {
-				v := s.getMember(member)
-				w := s.getMovie(movie)
-				propensity := v.dot(w)
-				ch <- output{member, movie, propensity}
-			}
-		}(movie)
+	return scorePerMovie(memberids, movieids, s.getMember, s.getMovie)
+}
+
+// Scans members in [low, high), the same bounds as pebble's IterOptions
+func (s *badgerstorage) queryRange(low uint32, high uint32, movieids []uint32) ([]output, error) {
+	movieids = distinct(movieids)
+	vs := make([]output, 0, rangeLen(low, high, s.cfg.members)*len(movieids))
+	if high <= low {
+		return vs, nil
 	}
+	lowerBound := uint32ToBeBytes(low)
+	upperBound := uint32ToBeBytes(high)
+	var v vector
+	err := s.memberdb.View(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iter.Close()
+		for _, movie := range movieids {
+			w, err := s.getMovie(movie)
+			if err != nil {
+				return err
+			}
+			if w == nil {
+				continue
+			}
+			for iter.Seek(lowerBound); iter.Valid(); iter.Next() {
+				item := iter.Item()
+				if bytes.Compare(item.Key(), upperBound) >= 0 {
+					break
+				}
+				member := binary.BigEndian.Uint32(item.Key())
+				err := item.Value(func(val []byte) (err error) {
+					if v, err = decodeVectorOf(v, val, len(w)); err != nil {
+						return err
+					}
+					vs = append(vs, output{member, movie, v.dot(w)})
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
 
-	for i := 0; i < capacity; i++ {
-		vs = append(vs, <-ch)
+	if err != nil {
+		return nil, err
 	}
-	return vs, nil
-}
 
-func (s *badgerstorage) queryRange(low uint32, high uint32, movieids []uint32) ([]output, error) {
-	vs := make([]output, 0, int(high-low)*len(movieids))
 	return vs, nil
 }
 
 func (s *badgerstorage) queryModel(memberids []uint32, models []MovieModel) ([]output, error) {
-	vs := make([]output, 0, len(memberids)*len(models))
-	return vs, nil
+	return scoreModels(memberids, models, s.getMember, s.getMovie)
 }
 
 func (s *badgerstorage) memberPropensities(movie uint32) ([]output, error) {
-	vs := make([]output, 0, N_MEMBERS)
-	err := s.memberdb.View(func(txn *badger.Txn) error {
-		iter := txn.NewIterator(badger.IteratorOptions{})
-		i := 0
+	return collectPropensities(s, movie, s.cfg.members)
+}
+
+func (s *badgerstorage) streamPropensities(movie uint32, f func([]output) error) error {
+	w, err := s.getMovie(movie)
+	if err != nil || w == nil {
+		return err
+	}
+
+	f = withProgress(s.name()+" member propensities", s.cfg.members, f)
+	if s.scan == "stream" {
+		return s.streamPropensitiesWithStream(movie, w, f)
+	}
+	return scanPartitioned(s.cfg.members, s.parallelism, f, func(r keyRange, emit func([]output) error) error {
+		lower, upper := r.bounds()
+		b := newBatcher(emit)
+		var v vector
+		err := s.memberdb.View(func(txn *badger.Txn) error {
+			iter := txn.NewIterator(badger.IteratorOptions{})
+			defer iter.Close()
+			for iter.Seek(lower); iter.Valid(); iter.Next() {
+				item := iter.Item()
+				if upper != nil && bytes.Compare(item.Key(), upper) >= 0 {
+					break
+				}
+				member := binary.BigEndian.Uint32(item.Key())
+				err := item.Value(func(val []byte) (err error) {
+					if v, err = decodeVectorOf(v, val, len(w)); err != nil {
+						return err
+					}
+					return b.add(output{member, movie, v.dot(w)})
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return b.flush()
+	})
+}
+
+// streamPropensitiesWithStream lets badger's Stream framework read the members with
+// parallelism goroutines. It copies the keys and values it reads into buffers that are
+// passed to Send one at a time, so the scoring itself happens on a single goroutine.
+func (s *badgerstorage) streamPropensitiesWithStream(movie uint32, w vector, f func([]output) error) error {
+	stream := s.memberdb.NewStream()
+	stream.NumGo = s.parallelism
+	stream.LogPrefix = "badger member propensities"
+
+	b := newBatcher(f)
+	var v vector
+	stream.Send = func(buf *z.Buffer) error {
+		list, err := badger.BufferToKVList(buf)
+		if err != nil {
+			return err
+		}
+		for _, kv := range list.Kv {
+			member := binary.BigEndian.Uint32(kv.Key)
+			if v, err = decodeVectorOf(v, kv.Value, len(w)); err != nil {
+				return err
+			}
+			if err := b.add(output{member, movie, v.dot(w)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := stream.Orchestrate(context.Background()); err != nil {
+		return err
+	}
+	return b.flush()
+}
+
+func (s *badgerstorage) topMembers(movie uint32, k int) ([]output, error) {
+	return topMembersByStream(s, movie, k, s.cfg.members)
+}
+
+func (s *badgerstorage) topMovies(member uint32, k int) ([]output, error) {
+	v, err := s.getMember(member)
+	if err != nil || v == nil {
+		return nil, err
+	}
+
+	top := newTopK(k, s.cfg.movies)
+	var w vector
+	err = s.moviedb.View(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iter.Close()
 		for iter.Rewind(); iter.Valid(); iter.Next() {
-			println(s.name(), "member propensity", i)
-			i++
-			if i == 1_000_000 {
-				break
+			movie := binary.BigEndian.Uint32(iter.Item().Key())
+			err := iter.Item().Value(func(val []byte) (err error) {
+				if w, err = decodeVectorOf(w, val, len(v)); err != nil {
+					return err
+				}
+				top.add(output{member, movie, v.dot(w)})
+				return nil
+			})
+			if err != nil {
+				return err
 			}
-			member := binary.BigEndian.Uint32(iter.Item().Key())
-			v := vecFromBytes(iter.Item().Key())
-			w := s.getMovie(movie)
-			propensity := v.dot(w)
-			vs = append(vs, output{member, movie, propensity})
 		}
 		return nil
 	})
-
 	if err != nil {
 		return nil, err
 	}
+	return top.sorted(), nil
+}
 
-	return vs, nil
+func (s *badgerstorage) scanMembers(f func(id uint32, v vector) error) error {
+	var v vector
+	return s.memberdb.View(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			member := binary.BigEndian.Uint32(iter.Item().Key())
+			err := iter.Item().Value(func(val []byte) (err error) {
+				if v, err = decodeVector(v, val); err != nil {
+					return err
+				}
+				return f(member, v)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
-func badgerGet(db *badger.DB, id uint32) vector {
+func badgerGet(db *badger.DB, id uint32) (vector, error) {
 	var vector vector
-	db.View(func(txn *badger.Txn) error {
+	err := db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get(uint32ToBeBytes(id))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-		return item.Value(func(val []byte) error {
-			vector = vecFromBytes(val)
-			return nil
+		return item.Value(func(val []byte) (err error) {
+			vector, err = decodeVector(nil, val)
+			return err
 		})
 	})
-	return vector
+	return vector, err
 }
 
-func (s *badgerstorage) getMember(id uint32) vector {
+func (s *badgerstorage) getMember(id uint32) (vector, error) {
 	return badgerGet(s.memberdb, id)
 }
 
-func (s *badgerstorage) getMovie(id uint32) vector {
+func (s *badgerstorage) getMovie(id uint32) (vector, error) {
 	return badgerGet(s.moviedb, id)
 }
 
 func (s *badgerstorage) insertRandomMembers(n int) error {
 	t, err := timed(func() error {
+		gen := s.cfg.generator()
+		// drop the previous load so ids it had that this one doesn't aren't left behind
+		if err := s.memberdb.DropAll(); err != nil {
+			return err
+		}
 		batch := s.memberdb.NewWriteBatch()
+		p := newProgress(s.name()+" members insert", n)
 		for i := 0; i < n; i++ {
-			println("badger insert (counting up)", i)
-			err := batch.Set(uint32ToBeBytes(uint32(i)), randomvec().toBytes())
+			p.add(1)
+			err := batch.Set(uint32ToBeBytes(uint32(i)), gen.member(uint32(i)).toBytes(s.cfg.encoding))
 			// err := s.memberdb.Update(func(txn *badger.Txn) error {
-			// 	if err := txn.Set(uint32ToBeBytes(uint32(i)), randomvec().toBytes()); err != nil {
+			// 	if err := txn.Set(uint32ToBeBytes(uint32(i)), gen.member(uint32(i)).toBytes(s.cfg.encoding)); err != nil {
 			// 		return err
 			// 	}
 			// 	return nil
@@ -137,14 +293,18 @@ func (s *badgerstorage) insertRandomMembers(n int) error {
 
 func (s *badgerstorage) insertRandomMovies(n int) error {
 	t, err := timed(func() error {
-		return s.moviedb.Update(func(txn *badger.Txn) error {
-			for i := 0; i < n; i++ {
-				if err := txn.Set(uint32ToBeBytes(uint32(i)), randomvec().toBytes()); err != nil {
-					return err
-				}
+		gen := s.cfg.generator()
+		if err := s.moviedb.DropAll(); err != nil {
+			return err
+		}
+		// a single transaction fails with ErrTxnTooBig on large datasets, the batch commits as it fills
+		batch := s.moviedb.NewWriteBatch()
+		for i := 0; i < n; i++ {
+			if err := batch.Set(uint32ToBeBytes(uint32(i)), gen.movie(uint32(i)).toBytes(s.cfg.encoding)); err != nil {
+				return err
 			}
-			return nil
-		})
+		}
+		return batch.Flush()
 	})
 
 	if err != nil {
@@ -154,3 +314,10 @@ func (s *badgerstorage) insertRandomMovies(n int) error {
 	println(s.name(), "movie insert time", t.Milliseconds())
 	return nil
 }
+
+func (s *badgerstorage) close() error {
+	if err := s.memberdb.Close(); err != nil {
+		return err
+	}
+	return s.moviedb.Close()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// encoding is how the elements of a stored vector are represented. It's recorded in
+// the header of every encoded vector so a dataset is read back the way it was loaded.
+type encoding uint8
+
+const (
+	ENCODING_FLOAT64 encoding = iota
+	// float32 elements, half the size with ~7 significant digits
+	ENCODING_FLOAT32
+	// elements scalar quantized to int8, multiplied by a float32 scale stored per vector
+	ENCODING_INT8
+)
+
+var encodingNames = []string{"float64", "float32", "int8"}
+
+// The header is a little endian uint32, the dimension in the low 24 bits and the
+// encoding in the high 8. float64 is 0 so vectors encoded before there was a choice
+// of encoding still decode.
+const (
+	HEADER_LEN    = 4
+	MAX_DIM       = 1<<24 - 1
+	ENCODING_BITS = 24
+)
+
+func parseEncoding(name string) (encoding, error) {
+	for i, n := range encodingNames {
+		if n == name {
+			return encoding(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown encoding %q", name)
+}
+
+func (e encoding) String() string {
+	if int(e) < len(encodingNames) {
+		return encodingNames[e]
+	}
+	return fmt.Sprintf("encoding(%d)", e)
+}
+
+func encodedLen(e encoding, dim int) int {
+	switch e {
+	case ENCODING_FLOAT32:
+		return HEADER_LEN + 4*dim
+	case ENCODING_INT8:
+		return HEADER_LEN + 4 + dim
+	default:
+		return HEADER_LEN + 8*dim
+	}
+}
+
+// decodeHeader returns the encoding and dimension of an encoded vector
+func decodeHeader(src []byte) (encoding, int, error) {
+	if len(src) < HEADER_LEN {
+		return 0, 0, fmt.Errorf("encoded vector is %d bytes, too short for the header", len(src))
+	}
+	header := binary.LittleEndian.Uint32(src)
+	e, dim := encoding(header>>ENCODING_BITS), int(header&MAX_DIM)
+	if int(e) >= len(encodingNames) {
+		return 0, 0, fmt.Errorf("encoded vector has unknown encoding %d", e)
+	}
+	return e, dim, nil
+}
+
+// encodeVector appends the encoding of v to dst, it doesn't allocate if dst has room for it
+func encodeVector(dst []byte, v vector, e encoding) []byte {
+	start := len(dst)
+	n := encodedLen(e, len(v))
+	if cap(dst)-start < n {
+		grown := make([]byte, start, start+n)
+		copy(grown, dst)
+		dst = grown
+	}
+	dst = dst[:start+n]
+	buf := dst[start:]
+	binary.LittleEndian.PutUint32(buf, uint32(e)<<ENCODING_BITS|uint32(len(v)))
+	buf = buf[HEADER_LEN:]
+
+	switch e {
+	case ENCODING_FLOAT32:
+		for i, x := range v {
+			binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(float32(x)))
+		}
+	case ENCODING_INT8:
+		// symmetric quantization so the largest magnitude element maps to ±127
+		var max float64
+		for _, x := range v {
+			max = math.Max(max, math.Abs(x))
+		}
+		scale := float32(max / 127)
+		binary.LittleEndian.PutUint32(buf, math.Float32bits(scale))
+		for i, x := range v {
+			var q float64
+			if scale != 0 {
+				q = math.Round(x / float64(scale))
+			}
+			buf[4+i] = byte(int8(math.Max(-127, math.Min(127, q))))
+		}
+	default:
+		for i, x := range v {
+			binary.LittleEndian.PutUint64(buf[8*i:], math.Float64bits(x))
+		}
+	}
+	return dst
+}
+
+// decodeVector decodes src into dst, reusing dst's storage if it's big enough.
+// Scans pass the previous vector back in so decoding each row doesn't allocate.
+// decodeVectorOf decodes src like decodeVector and checks it can be scored against a
+// vector of dimension dim, see checkDims
+func decodeVectorOf(dst vector, src []byte, dim int) (vector, error) {
+	v, err := decodeVector(dst, src)
+	if err != nil {
+		return nil, err
+	}
+	return v, checkDims(v, dim)
+}
+
+func decodeVector(dst vector, src []byte) (vector, error) {
+	e, dim, err := decodeHeader(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(src) < encodedLen(e, dim) {
+		return nil, fmt.Errorf("%s vector of dimension %d is %d bytes, expected %d", e, dim, len(src), encodedLen(e, dim))
+	}
+	if dst == nil || cap(dst) < dim {
+		dst = make(vector, dim)
+	}
+	dst = dst[:dim]
+	src = src[HEADER_LEN:]
+
+	switch e {
+	case ENCODING_FLOAT32:
+		for i := range dst {
+			dst[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(src[4*i:])))
+		}
+	case ENCODING_INT8:
+		scale := float64(math.Float32frombits(binary.LittleEndian.Uint32(src)))
+		for i := range dst {
+			dst[i] = float64(int8(src[4+i])) * scale
+		}
+	default:
+		for i := range dst {
+			dst[i] = math.Float64frombits(binary.LittleEndian.Uint64(src[8*i:]))
+		}
+	}
+	return dst, nil
+}
+
+// toBytes encodes v into a new slice, for when the store keeps a reference to the value
+func (v vector) toBytes(e encoding) []byte {
+	return encodeVector(nil, v, e)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+var codecTestVectors = []vector{{}, {1}, {0, 0}, {0.5, -2, 100, math.SmallestNonzeroFloat64}, newGenerator(1, 64, DISTRIBUTION_UNIFORM).member(3)}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, v := range codecTestVectors {
+		buf := encodeVector(nil, v, ENCODING_FLOAT64)
+		if len(buf) != encodedLen(ENCODING_FLOAT64, len(v)) {
+			t.Errorf("encoded %d elements into %d bytes, expected %d", len(v), len(buf), encodedLen(ENCODING_FLOAT64, len(v)))
+		}
+		decoded, err := decodeVector(nil, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, v) {
+			t.Errorf("decoded %v, expected %v", decoded, v)
+		}
+	}
+}
+
+// Lossy encodings should be within the precision of their element type
+func TestCodecLossyRoundTrip(t *testing.T) {
+	for _, v := range codecTestVectors {
+		for _, e := range []encoding{ENCODING_FLOAT32, ENCODING_INT8} {
+			buf := encodeVector(nil, v, e)
+			if len(buf) != encodedLen(e, len(v)) {
+				t.Errorf("%s: encoded %d elements into %d bytes, expected %d", e, len(v), len(buf), encodedLen(e, len(v)))
+			}
+			decoded, err := decodeVector(nil, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(decoded) != len(v) {
+				t.Fatalf("%s: decoded %d elements, expected %d", e, len(decoded), len(v))
+			}
+
+			var max float64
+			for _, x := range v {
+				max = math.Max(max, math.Abs(x))
+			}
+			for i, x := range v {
+				// relative precision of float32, or underflow to 0
+				tolerance := math.Abs(x)*1e-7 + math.SmallestNonzeroFloat32
+				if e == ENCODING_INT8 {
+					// half a quantization step, plus rounding of the float32 scale
+					tolerance = max/127/2 + max*1e-7
+				}
+				if math.Abs(decoded[i]-x) > tolerance {
+					t.Errorf("%s: element %d decoded as %g, expected %g within %g", e, i, decoded[i], x, tolerance)
+				}
+			}
+		}
+	}
+}
+
+// The codec has to stay compatible with data loaded by the binary.Write encoding it replaced
+func TestCodecMatchesBinaryEncoding(t *testing.T) {
+	v := newGenerator(1, 10, DISTRIBUTION_UNIFORM).member(0)
+	var expected bytes.Buffer
+	binary.Write(&expected, binary.LittleEndian, uint32(len(v)))
+	binary.Write(&expected, binary.LittleEndian, []float64(v))
+	if !bytes.Equal(encodeVector(nil, v, ENCODING_FLOAT64), expected.Bytes()) {
+		t.Error("encoding differs from binary.Write")
+	}
+}
+
+func TestCodecAppendsAndReuses(t *testing.T) {
+	prefix := []byte{1, 2, 3}
+	buf := encodeVector(prefix, vector{4}, ENCODING_FLOAT64)
+	if !bytes.Equal(buf[:3], prefix) || len(buf) != 3+encodedLen(ENCODING_FLOAT64, 1) {
+		t.Errorf("encodeVector should append to dst, got %v", buf)
+	}
+
+	dst := make(vector, 0, 4)
+	decoded, err := decodeVector(dst, encodeVector(nil, vector{1, 2}, ENCODING_FLOAT64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &decoded[0] != &dst[:1][0] {
+		t.Error("decodeVector should reuse dst when it's big enough")
+	}
+}
+
+func TestCodecInvalid(t *testing.T) {
+	for _, e := range []encoding{ENCODING_FLOAT64, ENCODING_FLOAT32, ENCODING_INT8} {
+		buf := encodeVector(nil, vector{1, 2, 3}, e)
+		for _, n := range []int{0, 3, len(buf) - 1} {
+			if _, err := decodeVector(nil, buf[:n]); err == nil {
+				t.Errorf("%s: decoding %d of %d bytes should fail", e, n, len(buf))
+			}
+		}
+	}
+
+	buf := encodeVector(nil, vector{1}, ENCODING_FLOAT64)
+	buf[3] = 0xff
+	if _, err := decodeVector(nil, buf); err == nil {
+		t.Error("decoding an unknown encoding should fail")
+	}
+}
+
+func TestMeasurePrecision(t *testing.T) {
+	cfg := conformanceConfig
+	var previous precision
+	for i := range encodingNames {
+		p, err := measurePrecision(cfg, encoding(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.encoding == ENCODING_FLOAT64 {
+			if p.maxAbsError != 0 {
+				t.Errorf("float64 should be exact, got a max error of %g", p.maxAbsError)
+			}
+		} else if p.payloadBytes >= previous.payloadBytes || p.maxAbsError <= previous.maxAbsError {
+			t.Errorf("%s should be smaller and less precise than %s", p.encoding, previous.encoding)
+		}
+		previous = p
+	}
+}
+
+// flat stores nothing but the encoded vectors so its size on disk is exactly their length
+func TestMeasureDiskSize(t *testing.T) {
+	cfg := conformanceConfig
+	for i := range encodingNames {
+		cfg.encoding = encoding(i)
+		perVector, err := measureDiskSize("flat", defaultBackendOptions(), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := float64(encodedLen(cfg.encoding, cfg.dim)); perVector != expected {
+			t.Errorf("%s uses %g bytes per vector on disk, expected %g", cfg.encoding, perVector, expected)
+		}
+	}
+}
+
+func BenchmarkEncodeVector(b *testing.B) {
+	for i := range encodingNames {
+		e := encoding(i)
+		b.Run(e.String(), func(b *testing.B) {
+			v := newGenerator(1, K, DISTRIBUTION_UNIFORM).member(0)
+			buf := make([]byte, 0, encodedLen(e, K))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buf = encodeVector(buf[:0], v, e)
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeVector(b *testing.B) {
+	for i := range encodingNames {
+		e := encoding(i)
+		b.Run(e.String(), func(b *testing.B) {
+			buf := encodeVector(nil, newGenerator(1, K, DISTRIBUTION_UNIFORM).member(0), e)
+			var v vector
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var err error
+				if v, err = decodeVector(v, buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// The binary.Read decoding the codec replaced, for comparison
+func BenchmarkDecodeVectorBinaryRead(b *testing.B) {
+	buf := encodeVector(nil, newGenerator(1, K, DISTRIBUTION_UNIFORM).member(0), ENCODING_FLOAT64)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r := bytes.NewReader(buf)
+		var dim uint32
+		binary.Read(r, binary.LittleEndian, &dim)
+		v := make(vector, dim)
+		binary.Read(r, binary.LittleEndian, []float64(v))
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// Number of members scored at once by the columnar kernel, small enough that the
+// accumulators stay in L1 while each column's block is streamed through
+const COLUMNAR_BLOCK_SIZE = 1024
+
+// columnarstorage stores dimension d of every vector contiguously in its own file,
+// so full scans read each column sequentially rather than one row at a time
+type columnarstorage struct {
+	members *columntable
+	movies  *columntable
+	cfg     config
+}
+
+// columntable is a set of mmapped column files <prefix>_0 ... <prefix>_<dim-1>
+// holding little endian float64s
+type columntable struct {
+	prefix string
+	// the mappings and views of them as float64s, both nil for an empty column
+	data    [][]byte
+	columns [][]float64
+	len     int
+}
+
+func newColumnar(cfg config) (*columnarstorage, error) {
+	members, err := openColumntable(filepath.Join(cfg.dir, "columnar_members"))
+	if err != nil {
+		return nil, err
+	}
+	movies, err := openColumntable(filepath.Join(cfg.dir, "columnar_movies"))
+	if err != nil {
+		members.close()
+		return nil, err
+	}
+	return &columnarstorage{members, movies, cfg}, nil
+}
+
+func (*columnarstorage) name() string {
+	return "columnar"
+}
+
+func columnPath(prefix string, d int) string {
+	return fmt.Sprintf("%s_%d", prefix, d)
+}
+
+// openColumntable maps every column file that exists, the dimension is the number of columns
+func openColumntable(prefix string) (*columntable, error) {
+	t := &columntable{prefix: prefix}
+	for d := 0; ; d++ {
+		f, err := os.Open(columnPath(prefix, d))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			t.close()
+			return nil, err
+		}
+
+		data, err := mmapFile(f)
+		f.Close()
+		if err != nil {
+			t.close()
+			return nil, err
+		}
+		t.data = append(t.data, data)
+		t.columns = append(t.columns, float64s(data))
+		if d == 0 {
+			t.len = len(data) / 8
+		} else if len(data)/8 != t.len {
+			t.close()
+			return nil, fmt.Errorf("column %s has %d rows, expected %d", columnPath(prefix, d), len(data)/8, t.len)
+		}
+	}
+	return t, nil
+}
+
+func mmapFile(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return nil, nil
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// float64s views the mapped column as float64s, this assumes a little endian host
+// which is every platform we benchmark on
+func float64s(data []byte) []float64 {
+	if len(data) == 0 {
+		return nil
+	}
+	return unsafe.Slice((*float64)(unsafe.Pointer(&data[0])), len(data)/8)
+}
+
+func (t *columntable) dim() int {
+	return len(t.columns)
+}
+
+func (t *columntable) get(id uint32) (vector, error) {
+	if int(id) >= t.len {
+		return nil, nil
+	}
+	v := make(vector, t.dim())
+	for d, column := range t.columns {
+		v[d] = column[id]
+	}
+	return v, nil
+}
+
+// score computes the dot product of w with every row in [low, high) a block at a time,
+// calling emit with the id of the first row in the block and the block's scores.
+// scores is reused between calls. It stops at the first error emit returns.
+func (t *columntable) score(low, high int, w vector, emit func(start int, scores []float64) error) error {
+	if err := checkDims(w, len(t.columns)); err != nil {
+		return err
+	}
+	var acc [COLUMNAR_BLOCK_SIZE]float64
+	for start := low; start < high; start += COLUMNAR_BLOCK_SIZE {
+		end := start + COLUMNAR_BLOCK_SIZE
+		if end > high {
+			end = high
+		}
+		scores := acc[:end-start]
+		for i := range scores {
+			scores[i] = 0
+		}
+		for d, column := range t.columns {
+			wd := w[d]
+			block := column[start:end]
+			for i, x := range block {
+				scores[i] += x * wd
+			}
+		}
+		if err := emit(start, scores); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load replaces every column file with the vectors [0, n)
+func (t *columntable) load(n int, dim int, vector func(id uint32) vector) error {
+	if err := t.close(); err != nil {
+		return err
+	}
+
+	files := make([]*os.File, dim)
+	writers := make([]*bufio.Writer, dim)
+	closeAll := func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}
+	for d := range files {
+		f, err := os.Create(columnPath(t.prefix, d))
+		if err != nil {
+			closeAll()
+			return err
+		}
+		files[d] = f
+		writers[d] = bufio.NewWriter(f)
+	}
+	// remove the columns of a previous load with a larger dimension
+	for d := dim; ; d++ {
+		if err := os.Remove(columnPath(t.prefix, d)); err != nil {
+			break
+		}
+	}
+
+	buf := make([]byte, 8)
+	for i := 0; i < n; i++ {
+		for d, x := range vector(uint32(i)) {
+			binary.LittleEndian.PutUint64(buf, math.Float64bits(x))
+			if _, err := writers[d].Write(buf); err != nil {
+				closeAll()
+				return err
+			}
+		}
+	}
+	for d, w := range writers {
+		if err := w.Flush(); err != nil {
+			closeAll()
+			return err
+		}
+		err := files[d].Close()
+		files[d] = nil
+		if err != nil {
+			closeAll()
+			return err
+		}
+	}
+
+	reopened, err := openColumntable(t.prefix)
+	if err != nil {
+		return err
+	}
+	*t = *reopened
+	return nil
+}
+
+func (t *columntable) close() error {
+	var err error
+	for _, data := range t.data {
+		if data == nil {
+			continue
+		}
+		if unmapErr := syscall.Munmap(data); err == nil {
+			err = unmapErr
+		}
+	}
+	t.data = nil
+	t.columns = nil
+	t.len = 0
+	return err
+}
+
+func (s *columnarstorage) query(memberids []uint32, movieids []uint32) ([]output, error) {
+	return scorePerMovie(memberids, movieids, s.members.get, s.movies.get)
+}
+
+func (s *columnarstorage) queryModel(memberids []uint32, models []MovieModel) ([]output, error) {
+	return scoreModels(memberids, models, s.members.get, s.movies.get)
+}
+
+func (s *columnarstorage) queryRange(low uint32, high uint32, movieids []uint32) ([]output, error) {
+	movieids = distinct(movieids)
+	n := rangeLen(low, high, s.members.len)
+	vs := make([]output, 0, n*len(movieids))
+	for _, movie := range movieids {
+		w, err := s.movies.get(movie)
+		if err != nil {
+			return nil, err
+		}
+		if w == nil {
+			continue
+		}
+		err = s.members.score(int(low), int(low)+n, w, func(start int, scores []float64) error {
+			for i, p := range scores {
+				vs = append(vs, output{uint32(start + i), movie, p})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return vs, nil
+}
+
+func (s *columnarstorage) memberPropensities(movie uint32) ([]output, error) {
+	w, err := s.movies.get(movie)
+	if err != nil || w == nil {
+		return nil, err
+	}
+
+	vs := make([]output, 0, s.members.len)
+	err = s.members.score(0, s.members.len, w, func(start int, scores []float64) error {
+		for i, p := range scores {
+			vs = append(vs, output{uint32(start + i), movie, p})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vs, nil
+}
+
+// streamPropensities passes each block of scores on as a batch
+func (s *columnarstorage) streamPropensities(movie uint32, f func([]output) error) error {
+	w, err := s.movies.get(movie)
+	if err != nil || w == nil {
+		return err
+	}
+
+	f = withProgress(s.name()+" member propensities", s.members.len, f)
+	batch := make([]output, 0, COLUMNAR_BLOCK_SIZE)
+	return s.members.score(0, s.members.len, w, func(start int, scores []float64) error {
+		batch = batch[:0]
+		for i, p := range scores {
+			batch = append(batch, output{uint32(start + i), movie, p})
+		}
+		return f(batch)
+	})
+}
+
+func (s *columnarstorage) topMembers(movie uint32, k int) ([]output, error) {
+	return topMembersByStream(s, movie, k, s.cfg.members)
+}
+
+// topMovies scores the movie columns against the member with the same kernel as the member scans
+func (s *columnarstorage) topMovies(member uint32, k int) ([]output, error) {
+	v, err := s.members.get(member)
+	if err != nil || v == nil {
+		return nil, err
+	}
+
+	top := newTopK(k, s.cfg.movies)
+	err = s.movies.score(0, s.movies.len, v, func(start int, scores []float64) error {
+		for i, p := range scores {
+			top.add(output{member, uint32(start + i), p})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return top.sorted(), nil
+}
+
+func (s *columnarstorage) getMovie(id uint32) (vector, error) {
+	return s.movies.get(id)
+}
+
+// scanMembers gathers each member from the columns, the layout isn't suited to reading rows
+func (s *columnarstorage) scanMembers(f func(id uint32, v vector) error) error {
+	v := make(vector, s.members.dim())
+	for member := 0; member < s.members.len; member++ {
+		for d, column := range s.members.columns {
+			v[d] = column[member]
+		}
+		if err := f(uint32(member), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *columnarstorage) insertRandomMembers(n int) error {
+	t, err := timed(func() error {
+		return s.members.load(n, s.cfg.dim, s.cfg.generator().member)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	println(s.name(), "members insert time", t.Milliseconds())
+	return nil
+}
+
+func (s *columnarstorage) insertRandomMovies(n int) error {
+	t, err := timed(func() error {
+		return s.movies.load(n, s.cfg.dim, s.cfg.generator().movie)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	println(s.name(), "movie insert time", t.Milliseconds())
+	return nil
+}
+
+func (s *columnarstorage) close() error {
+	if err := s.members.close(); err != nil {
+		return err
+	}
+	return s.movies.close()
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
-	"bytes"
 	"encoding/binary"
-	"math/rand"
+	"fmt"
+	"math"
+	"sync"
 	"time"
 )
 
@@ -13,64 +14,202 @@ type output struct {
 	propensity float64
 }
 
-func randomModels() []MovieModel {
-	models := make([]MovieModel, MODEL_QUERY_SIZE)
-	for i := 0; i < MODEL_QUERY_SIZE; i++ {
-		models[i] = randomModel()
+func uint32ToBeBytes(u uint32) []byte {
+	bytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(bytes, u)
+	return bytes
+}
+
+// vector has a dimension chosen per dataset, see config.dim
+type vector []float64
+
+// An empty vector, such as the average of a model with no movies, is treated as the zero vector.
+// Vectors of different dimensions can't be scored and return NaN, backends reject them
+// with checkDims before scoring.
+func (v vector) dot(w vector) float64 {
+	if len(v) == 0 || len(w) == 0 {
+		return 0
 	}
-	return models
+	if len(v) != len(w) {
+		return math.NaN()
+	}
+	dot := 0.0
+	for i := range v {
+		dot += v[i] * w[i]
+	}
+	return dot
 }
 
-func randomModel() MovieModel {
-	n := rand.Int() % 20
-	movies := make([]uint32, n)
-	for i := 0; i < n; i++ {
-		movies[i] = rand.Uint32() % N_MOVIES
+// checkDims returns an error if v can't be scored against a vector of dimension dim. The
+// backends that overwrite keys when loading can have vectors left over from an earlier load
+// with a different dim. An empty vector is the zero vector of any dimension.
+func checkDims(v vector, dim int) error {
+	if len(v) != dim && len(v) > 0 && dim > 0 {
+		return fmt.Errorf("can't score a vector of dimension %d against one of dimension %d, reload the dataset", len(v), dim)
 	}
-	return MovieModel{movies}
+	return nil
+}
 
+// addAssign allocates v if it is empty so a zero vector can be used as an accumulator
+func (v *vector) addAssign(w vector) {
+	if len(*v) == 0 {
+		*v = make(vector, len(w))
+	}
+	for i := range w {
+		(*v)[i] += w[i]
+	}
 }
 
-func uint32ToBeBytes(u uint32) []byte {
-	bytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(bytes, u)
-	return bytes
+func (v *vector) divAssign(divisor float64) {
+	for i := range *v {
+		(*v)[i] /= divisor
+	}
 }
 
-type vector struct {
-	Points [K]float64
+// The storage semantics shared by every backend, see conformance_test.go:
+//   - ids that aren't in the dataset are skipped
+//   - duplicate member and movie ids are only scored once, like pg's `id = any($1)`
+//   - ranges are [low, high)
+
+// getter fetches a vector by id, returning nil if there is no such id
+type getter func(id uint32) (vector, error)
+
+// modelVector averages the vectors of the movies in the model.
+// Duplicate and missing movie ids are only counted once in the sum but the divisor
+// is the full length of the model, matching pg's `id = any($1)` query.
+func modelVector(model MovieModel, get getter) (vector, error) {
+	v := vector{}
+	seen := make(map[uint32]bool, len(model.movies))
+	for _, movie := range model.movies {
+		if seen[movie] {
+			continue
+		}
+		seen[movie] = true
+		w, err := get(movie)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkDims(w, len(v)); err != nil {
+			return nil, err
+		}
+		v.addAssign(w)
+	}
+	v.divAssign(float64(len(model.movies)))
+	return v, nil
 }
 
-func (v vector) dot(w vector) float64 {
-	dot := 0.0
-	for i := 0; i < K; i++ {
-		dot += v.Points[i] * w.Points[i]
+// scoreModels scores each member against the average vector of each model
+func scoreModels(memberids []uint32, models []MovieModel, getMember, getMovie getter) ([]output, error) {
+	memberids = distinct(memberids)
+	vs := make([]output, 0, len(memberids)*len(models))
+
+	// this contains the averaged vectors for each model
+	movieVectors := make([]vector, 0, len(models))
+	for _, model := range models {
+		w, err := modelVector(model, getMovie)
+		if err != nil {
+			return nil, err
+		}
+		movieVectors = append(movieVectors, w)
 	}
-	return dot
+
+	for _, member := range memberids {
+		v, err := getMember(member)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			continue
+		}
+		for _, w := range movieVectors {
+			if err := checkDims(v, len(w)); err != nil {
+				return nil, err
+			}
+			// Models don't have a movie id, see pgstorage.queryModel
+			vs = append(vs, output{member: member, movie: math.MaxUint32, propensity: v.dot(w)})
+		}
+	}
+	return vs, nil
 }
 
-func (v vector) addAssign(w vector) {
-	for i := 0; i < K; i++ {
-		v.Points[i] += w.Points[i]
+// scorePerMovie scores every member against each movie, with a goroutine per movie
+func scorePerMovie(memberids []uint32, movieids []uint32, getMember, getMovie getter) ([]output, error) {
+	memberids = distinct(memberids)
+	movieids = distinct(movieids)
+
+	results := make([][]output, len(movieids))
+	errs := make([]error, len(movieids))
+	var wg sync.WaitGroup
+	for i, movie := range movieids {
+		wg.Add(1)
+		go func(i int, movie uint32) {
+			defer wg.Done()
+			w, err := getMovie(movie)
+			if err != nil || w == nil {
+				errs[i] = err
+				return
+			}
+			vs := make([]output, 0, len(memberids))
+			for _, member := range memberids {
+				v, err := getMember(member)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				if v == nil {
+					continue
+				}
+				if err := checkDims(v, len(w)); err != nil {
+					errs[i] = err
+					return
+				}
+				vs = append(vs, output{member, movie, v.dot(w)})
+			}
+			results[i] = vs
+		}(i, movie)
+	}
+	wg.Wait()
+
+	vs := make([]output, 0, len(memberids)*len(movieids))
+	for i := range results {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		vs = append(vs, results[i]...)
 	}
+	return vs, nil
 }
 
-func (v vector) divAssign(divisor float64) {
-	for i := 0; i < K; i++ {
-		v.Points[i] /= divisor
+// distinct returns ids without duplicates, keeping the first occurrence of each
+func distinct(ids []uint32) []uint32 {
+	seen := make(map[uint32]bool, len(ids))
+	xs := make([]uint32, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			xs = append(xs, id)
+		}
 	}
+	return xs
 }
 
-func (v vector) toBytes() []byte {
-	buf := bytes.NewBuffer([]byte{})
-	binary.Write(buf, binary.LittleEndian, v)
-	return buf.Bytes()
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
 }
 
-func vecFromBytes(buf []byte) vector {
-	var v vector
-	binary.Read(bytes.NewBuffer(buf), binary.LittleEndian, &v)
-	return v
+// rangeLen is the number of ids in [low, high) that can exist in a dataset of n ids,
+// used to size the results of range queries
+func rangeLen(low uint32, high uint32, n int) int {
+	if uint64(high) > uint64(n) {
+		high = uint32(n)
+	}
+	if high <= low {
+		return 0
+	}
+	return int(high - low)
 }
 
 func timed(f func() error) (time.Duration, error) {
@@ -89,10 +228,155 @@ func makeRange(min, max uint32) []uint32 {
 	return a
 }
 
-func randomvec() vector {
-	v := vector{}
-	for i := 0; i < K; i++ {
-		v.Points[i] = rand.Float64()
+// Number of outputs passed to each call of a stream callback
+const STREAM_BATCH_SIZE = 4096
+
+// batcher buffers streamed outputs and passes them to f a batch at a time.
+// The batch is reused once f returns so f mustn't keep it.
+type batcher struct {
+	batch []output
+	f     func([]output) error
+}
+
+func newBatcher(f func([]output) error) *batcher {
+	return &batcher{make([]output, 0, STREAM_BATCH_SIZE), f}
+}
+
+func (b *batcher) add(o output) error {
+	b.batch = append(b.batch, o)
+	if len(b.batch) == STREAM_BATCH_SIZE {
+		return b.flush()
+	}
+	return nil
+}
+
+// flush passes any buffered outputs to f, it must be called once the stream ends
+func (b *batcher) flush() error {
+	if len(b.batch) == 0 {
+		return nil
+	}
+	err := b.f(b.batch)
+	b.batch = b.batch[:0]
+	return err
+}
+
+// Minimum time between progress reports of a long running scan
+const PROGRESS_INTERVAL = 5 * time.Second
+
+// progress periodically prints how many of the expected total items are done and
+// the rate since it started, so long loads and scans aren't silent
+type progress struct {
+	name  string
+	total int
+	done  int
+	start time.Time
+	last  time.Time
+}
+
+func newProgress(name string, total int) *progress {
+	now := time.Now()
+	return &progress{name: name, total: total, start: now, last: now}
+}
+
+func (p *progress) add(n int) {
+	p.done += n
+	if now := time.Now(); now.Sub(p.last) >= PROGRESS_INTERVAL {
+		p.last = now
+		println(p.name, p.done, "of", p.total, "done,", int(float64(p.done)/now.Sub(p.start).Seconds()), "per second")
+	}
+}
+
+// withProgress wraps a stream callback to report the progress of the outputs streamed
+func withProgress(name string, total int, f func([]output) error) func([]output) error {
+	p := newProgress(name, total)
+	return func(batch []output) error {
+		p.add(len(batch))
+		return f(batch)
+	}
+}
+
+// collectPropensities materializes a stream of propensities, sizeHint is the expected number of outputs
+func collectPropensities(s storage, movie uint32, sizeHint int) ([]output, error) {
+	vs := make([]output, 0, sizeHint)
+	err := s.streamPropensities(movie, func(batch []output) error {
+		vs = append(vs, batch...)
+		return nil
+	})
+	return vs, err
+}
+
+// keyRange is a range of big endian uint32 keys [low, high), or [low, ∞) if it's open
+type keyRange struct {
+	low  uint32
+	high uint32
+	open bool
+}
+
+// bounds returns the range as the lower and upper bound of an iterator, upper is nil if the range is open
+func (r keyRange) bounds() ([]byte, []byte) {
+	if r.open {
+		return uint32ToBeBytes(r.low), nil
+	}
+	return uint32ToBeBytes(r.low), uint32ToBeBytes(r.high)
+}
+
+// partition splits the ids [0, n) into parallelism contiguous ranges. The last range is
+// open so ids past n, if there are any, are still scanned.
+func partition(n int, parallelism int) []keyRange {
+	if parallelism > n {
+		parallelism = n
+	}
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	ranges := make([]keyRange, parallelism)
+	for i := range ranges {
+		ranges[i] = keyRange{
+			low:  uint32(uint64(i) * uint64(n) / uint64(parallelism)),
+			high: uint32(uint64(i+1) * uint64(n) / uint64(parallelism)),
+			open: i == parallelism-1,
+		}
+	}
+	return ranges
+}
+
+// scanPartitioned scans the ranges of partition(n, parallelism) with a goroutine each.
+// Every scan's batches go through emit, which passes them to f one at a time so f doesn't
+// need to be safe for concurrent use. Once f or a scan fails, emit returns the error so
+// the other scans stop early. Batches from different ranges are interleaved.
+func scanPartitioned(n int, parallelism int, f func([]output) error, scan func(r keyRange, emit func([]output) error) error) error {
+	var mu sync.Mutex
+	var firstErr error
+	fail := func(err error) error {
+		if firstErr == nil {
+			firstErr = err
+		}
+		return firstErr
+	}
+	emit := func(batch []output) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr != nil {
+			return firstErr
+		}
+		if err := f(batch); err != nil {
+			return fail(err)
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for _, r := range partition(n, parallelism) {
+		wg.Add(1)
+		go func(r keyRange) {
+			defer wg.Done()
+			if err := scan(r, emit); err != nil {
+				mu.Lock()
+				fail(err)
+				mu.Unlock()
+			}
+		}(r)
 	}
-	return v
+	wg.Wait()
+	return firstErr
 }
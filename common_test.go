@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestBatcher(t *testing.T) {
+	var batches [][]output
+	b := newBatcher(func(batch []output) error {
+		// the batch is reused so it has to be copied
+		batches = append(batches, append([]output(nil), batch...))
+		return nil
+	})
+
+	n := 2*STREAM_BATCH_SIZE + 3
+	for i := 0; i < n; i++ {
+		if err := b.add(output{member: uint32(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := make([]int, len(batches))
+	var members []uint32
+	for i, batch := range batches {
+		sizes[i] = len(batch)
+		for _, o := range batch {
+			members = append(members, o.member)
+		}
+	}
+	if expected := []int{STREAM_BATCH_SIZE, STREAM_BATCH_SIZE, 3}; !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("batch sizes %v, expected %v", sizes, expected)
+	}
+	if !reflect.DeepEqual(members, makeRange(0, uint32(n))) {
+		t.Error("outputs should be streamed in order")
+	}
+
+	if err := b.flush(); err != nil || len(batches) != 3 {
+		t.Error("flushing an empty batcher shouldn't call f")
+	}
+}
+
+func TestPartition(t *testing.T) {
+	for _, c := range []struct{ n, parallelism, ranges int }{{100, 1, 1}, {100, 3, 3}, {100, 200, 100}, {0, 4, 1}} {
+		ranges := partition(c.n, c.parallelism)
+		if len(ranges) != c.ranges {
+			t.Errorf("partition(%d, %d) returned %d ranges, expected %d", c.n, c.parallelism, len(ranges), c.ranges)
+			continue
+		}
+		// the ranges should be contiguous from 0 with only the last one open
+		next := uint32(0)
+		for i, r := range ranges {
+			if r.low != next || r.open != (i == len(ranges)-1) {
+				t.Errorf("partition(%d, %d) range %d is %+v", c.n, c.parallelism, i, r)
+			}
+			next = r.high
+		}
+		if int(next) != c.n {
+			t.Errorf("partition(%d, %d) ends at %d", c.n, c.parallelism, next)
+		}
+	}
+}
+
+func TestDimensionMismatch(t *testing.T) {
+	v, w := vector{1, 2, 3}, vector{1, 2}
+	if p := v.dot(w); !math.IsNaN(p) {
+		t.Errorf("vectors of different dimensions should score NaN, got %g", p)
+	}
+	if p := v.dot(nil); p != 0 {
+		t.Errorf("an empty vector should score 0, got %g", p)
+	}
+	if checkDims(v, 2) == nil {
+		t.Error("checkDims should reject a vector of a different dimension")
+	}
+	if checkDims(v, 3) != nil || checkDims(nil, 3) != nil {
+		t.Error("checkDims should accept vectors of the same dimension and empty vectors")
+	}
+	if _, err := decodeVectorOf(nil, encodeVector(nil, v, ENCODING_FLOAT64), 2); err == nil {
+		t.Error("decodeVectorOf should reject a vector of a different dimension")
+	}
+}
+
+// A member left over from a load with a larger dim has to be an error rather than a panic
+func TestStaleDimensionIsAnError(t *testing.T) {
+	s := openConformanceBackend(t, "pebble", nil)
+	if err := s.(*pebblestorage).setMember(50, vector{1, 2, 3, 4, 5, 6}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := collectPropensities(s, 3, 0); err == nil {
+		t.Error("streaming propensities should fail")
+	}
+	if _, err := s.query([]uint32{50}, []uint32{3}); err == nil {
+		t.Error("querying the member should fail")
+	}
+	if _, err := s.topMovies(50, 5); err == nil {
+		t.Error("the member's top movies should fail")
+	}
+}
+
+// Loading a smaller dataset over a larger one mustn't leave the larger one's members behind
+func TestReloadReplacesMembers(t *testing.T) {
+	for _, name := range []string{"pebble", "badger", "sqlite"} {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			s := openConformanceBackend(t, name, nil)
+			if err := s.insertRandomMembers(conformanceConfig.members / 2); err != nil {
+				t.Fatal(err)
+			}
+			n := 0
+			if err := s.scanMembers(func(uint32, vector) error { n++; return nil }); err != nil {
+				t.Fatal(err)
+			}
+			if n != conformanceConfig.members/2 {
+				t.Errorf("%d members after reloading %d", n, conformanceConfig.members/2)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+type comparison struct {
+	backend  string
+	scenario string
+	old      latencyReport
+	newer    latencyReport
+	// relative change of the median latency, 0.1 is 10% slower
+	change float64
+	// two-sided p-value of the samples coming from the same distribution
+	p float64
+}
+
+func (c comparison) significant(alpha float64) bool {
+	return c.p < alpha
+}
+
+func (c comparison) regressed(threshold, alpha float64) bool {
+	return c.change > threshold && c.significant(alpha)
+}
+
+func runCompare(args []string) error {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: storage-perf compare [flags] <old.json> <new.json>\n\nflags can come before or after the reports")
+		fs.PrintDefaults()
+	}
+	threshold := fs.Float64("threshold", 0.1, "relative slowdown of the median latency that counts as a regression")
+	alpha := fs.Float64("alpha", 0.05, "significance level for the difference in latency distributions")
+	paths, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(paths) != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	old, err := readReport(paths[0])
+	if err != nil {
+		return err
+	}
+	newer, err := readReport(paths[1])
+	if err != nil {
+		return err
+	}
+
+	if old.Dataset != newer.Dataset {
+		fmt.Fprintf(os.Stderr, "warning: the reports were run with different datasets, %+v and %+v\n", old.Dataset, newer.Dataset)
+	}
+	if old.Settings != newer.Settings {
+		fmt.Fprintf(os.Stderr, "warning: the reports were run with different backend settings, %+v and %+v\n", old.Settings, newer.Settings)
+	}
+
+	comparisons := compareReports(old, newer)
+	regressions := 0
+	fmt.Printf("%-8s %-14s %10s %10s %8s %8s\n", "backend", "scenario", "old p50", "new p50", "change", "p")
+	for _, c := range comparisons {
+		verdict := ""
+		if c.regressed(*threshold, *alpha) {
+			verdict = "REGRESSION"
+			regressions++
+		} else if c.change < -*threshold && c.significant(*alpha) {
+			verdict = "improvement"
+		} else if !c.significant(*alpha) {
+			verdict = "~"
+		}
+		fmt.Printf("%-8s %-14s %10s %10s %+7.1f%% %8.3f %s\n",
+			c.backend, c.scenario, fmtMs(c.old.P50), fmtMs(c.newer.P50), c.change*100, c.p, verdict)
+	}
+
+	if regressions > 0 {
+		return fmt.Errorf("%d scenario(s) regressed by more than %.0f%%", regressions, *threshold*100)
+	}
+	return nil
+}
+
+func readReport(path string) (*report, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r report
+	if err := json.NewDecoder(f).Decode(&r); err != nil {
+		return nil, fmt.Errorf("failed to read report %s: %v", path, err)
+	}
+	return &r, nil
+}
+
+// parseInterspersed parses flags wherever they are among the positional arguments and
+// returns the positional arguments, fs.Parse alone stops at the first positional argument
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// compareReports pairs up the results of both reports by backend and scenario,
+// results that are only in one of the reports are skipped
+func compareReports(old, newer *report) []comparison {
+	type key struct{ backend, scenario string }
+	olds := make(map[key]result, len(old.Results))
+	for _, x := range old.Results {
+		olds[key{x.Backend, x.Scenario}] = x
+	}
+
+	var comparisons []comparison
+	for _, y := range newer.Results {
+		x, ok := olds[key{y.Backend, y.Scenario}]
+		if !ok {
+			continue
+		}
+		change := 0.0
+		if x.Latency.P50 > 0 {
+			change = float64(y.Latency.P50-x.Latency.P50) / float64(x.Latency.P50)
+		}
+		comparisons = append(comparisons, comparison{
+			backend:  y.Backend,
+			scenario: y.Scenario,
+			old:      x.Latency,
+			newer:    y.Latency,
+			change:   change,
+			p:        mannWhitneyU(x.Samples, y.Samples),
+		})
+	}
+	return comparisons
+}
+
+// mannWhitneyU returns the two-sided p-value of the Mann-Whitney U test using the
+// normal approximation with a tie correction. It makes no assumption about the
+// shape of the distributions, latencies are rarely normally distributed.
+func mannWhitneyU(xs, ys []int64) float64 {
+	n1, n2 := float64(len(xs)), float64(len(ys))
+	if n1 == 0 || n2 == 0 {
+		return 1
+	}
+
+	type sample struct {
+		value int64
+		first bool
+	}
+	samples := make([]sample, 0, len(xs)+len(ys))
+	for _, x := range xs {
+		samples = append(samples, sample{x, true})
+	}
+	for _, y := range ys {
+		samples = append(samples, sample{y, false})
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].value < samples[j].value })
+
+	// rank the samples, ties get the average of the ranks they span
+	r1 := 0.0
+	ties := 0.0
+	for i := 0; i < len(samples); {
+		j := i
+		for j < len(samples) && samples[j].value == samples[i].value {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if samples[k].first {
+				r1 += rank
+			}
+		}
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+
+	n := n1 + n2
+	u := r1 - n1*(n1+1)/2
+	mean := n1 * n2 / 2
+	variance := n1 * n2 / 12 * (n + 1 - ties/(n*(n-1)))
+	if variance <= 0 {
+		return 1
+	}
+	z := (math.Abs(u-mean) - 0.5) / math.Sqrt(variance)
+	if z < 0 {
+		z = 0
+	}
+	return math.Erfc(z / math.Sqrt2)
+}
+
+func fmtMs(ns int64) string {
+	return fmt.Sprintf("%.2fms", float64(ns)/float64(time.Millisecond))
+}
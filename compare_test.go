@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMannWhitneyU(t *testing.T) {
+	xs := []int64{10, 11, 12, 13, 14, 15, 16, 17, 18, 19}
+	if p := mannWhitneyU(xs, xs); p < 0.9 {
+		t.Errorf("identical samples should not be significant, p = %f", p)
+	}
+
+	ys := []int64{20, 21, 22, 23, 24, 25, 26, 27, 28, 29}
+	if p := mannWhitneyU(xs, ys); p > 0.001 {
+		t.Errorf("disjoint samples should be significant, p = %f", p)
+	}
+
+	if p := mannWhitneyU([]int64{5}, []int64{5}); p != 1 {
+		t.Errorf("all tied samples should have p = 1, got %f", p)
+	}
+	if p := mannWhitneyU(nil, ys); p != 1 {
+		t.Errorf("empty samples should have p = 1, got %f", p)
+	}
+}
+
+func TestCompareReports(t *testing.T) {
+	newResult := func(backend string, scenario string, samples ...time.Duration) result {
+		h := newHistogram(len(samples))
+		for _, d := range samples {
+			h.record(d)
+		}
+		r := &report{}
+		r.add(backend, scenario, 0, h)
+		return r.Results[0]
+	}
+
+	ms := time.Millisecond
+	old := &report{Results: []result{
+		newResult("pebble", "query", 10*ms, 11*ms, 10*ms, 12*ms, 11*ms, 10*ms, 11*ms, 12*ms),
+		newResult("pebble", "range", 10*ms, 11*ms, 10*ms, 12*ms, 11*ms, 10*ms, 11*ms, 12*ms),
+		newResult("badger", "query", 10*ms),
+	}}
+	newer := &report{Results: []result{
+		newResult("pebble", "query", 20*ms, 21*ms, 20*ms, 22*ms, 21*ms, 20*ms, 21*ms, 22*ms),
+		newResult("pebble", "range", 10*ms, 12*ms, 11*ms, 10*ms, 11*ms, 12*ms, 10*ms, 11*ms),
+		newResult("pg", "query", 10*ms),
+	}}
+
+	comparisons := compareReports(old, newer)
+	if len(comparisons) != 2 {
+		t.Fatalf("expected 2 comparisons, got %d", len(comparisons))
+	}
+	if c := comparisons[0]; c.scenario != "query" || !c.regressed(0.1, 0.05) {
+		t.Errorf("expected query to regress: %+v", c)
+	}
+	if c := comparisons[1]; c.scenario != "range" || c.regressed(0.1, 0.05) || c.change != 0 {
+		t.Errorf("expected range to be unchanged: %+v", c)
+	}
+}
+
+func TestParseInterspersed(t *testing.T) {
+	for _, args := range [][]string{
+		{"-threshold", "0.2", "old.json", "new.json"},
+		{"old.json", "new.json", "-threshold", "0.2"},
+		{"old.json", "-threshold=0.2", "new.json"},
+	} {
+		fs := flag.NewFlagSet("compare", flag.ContinueOnError)
+		threshold := fs.Float64("threshold", 0.1, "")
+		positional, err := parseInterspersed(fs, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(positional, []string{"old.json", "new.json"}) || *threshold != 0.2 {
+			t.Errorf("%v: got %v and a threshold of %g", args, positional, *threshold)
+		}
+	}
+}
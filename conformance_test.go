@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// A small dataset so every backend can be loaded from scratch for each test run
+var conformanceConfig = config{
+	members:         100,
+	movies:          20,
+	dim:             4,
+	seed:            7,
+	movieQuerySize:  5,
+	modelQuerySize:  4,
+	memberQuerySize: 10,
+}
+
+type conformanceCase struct {
+	name string
+	run  func(storage) ([]output, error)
+	// expected number of outputs, checked in addition to comparing against the oracle
+	len int
+}
+
+var conformanceCases = []conformanceCase{
+	{"query", func(s storage) ([]output, error) {
+		return s.query(makeRange(0, 10), makeRange(0, 5))
+	}, 50},
+	{"query missing ids", func(s storage) ([]output, error) {
+		return s.query([]uint32{5, 100, 1000}, []uint32{1, 20, 500})
+	}, 1},
+	{"query duplicate ids", func(s storage) ([]output, error) {
+		return s.query([]uint32{3, 3, 4}, []uint32{2, 2})
+	}, 2},
+	{"query no members", func(s storage) ([]output, error) {
+		return s.query(nil, makeRange(0, 5))
+	}, 0},
+	{"query no movies", func(s storage) ([]output, error) {
+		return s.query(makeRange(0, 10), nil)
+	}, 0},
+	{"models", func(s storage) ([]output, error) {
+		models := []MovieModel{{[]uint32{1, 2, 3}}, {[]uint32{7}}}
+		return s.queryModel(makeRange(0, 10), models)
+	}, 20},
+	{"models with duplicate, missing and no movies", func(s storage) ([]output, error) {
+		models := []MovieModel{{[]uint32{4, 4, 5}}, {[]uint32{1, 25}}, {}}
+		return s.queryModel(makeRange(0, 10), models)
+	}, 30},
+	{"models missing and duplicate members", func(s storage) ([]output, error) {
+		models := []MovieModel{{[]uint32{1, 2, 3}}}
+		return s.queryModel([]uint32{1, 1, 99, 100}, models)
+	}, 2},
+	{"models no members", func(s storage) ([]output, error) {
+		return s.queryModel(nil, []MovieModel{{[]uint32{1}}})
+	}, 0},
+	{"models no models", func(s storage) ([]output, error) {
+		return s.queryModel(makeRange(0, 10), nil)
+	}, 0},
+	{"range", func(s storage) ([]output, error) {
+		return s.queryRange(10, 20, makeRange(0, 3))
+	}, 30},
+	{"range first member", func(s storage) ([]output, error) {
+		return s.queryRange(0, 1, []uint32{0})
+	}, 1},
+	{"range last member", func(s storage) ([]output, error) {
+		return s.queryRange(99, 100, []uint32{0})
+	}, 1},
+	{"range past the last member", func(s storage) ([]output, error) {
+		return s.queryRange(95, 120, []uint32{0})
+	}, 5},
+	{"range outside the dataset", func(s storage) ([]output, error) {
+		return s.queryRange(100, 200, []uint32{0})
+	}, 0},
+	{"range empty", func(s storage) ([]output, error) {
+		return s.queryRange(5, 5, []uint32{0})
+	}, 0},
+	{"range inverted", func(s storage) ([]output, error) {
+		return s.queryRange(20, 10, []uint32{0})
+	}, 0},
+	{"range duplicate and missing movies", func(s storage) ([]output, error) {
+		return s.queryRange(0, 10, []uint32{1, 1, 20})
+	}, 10},
+	{"propensities", func(s storage) ([]output, error) {
+		return s.memberPropensities(3)
+	}, 100},
+	{"propensities missing movie", func(s storage) ([]output, error) {
+		return s.memberPropensities(20)
+	}, 0},
+	{"stream propensities", func(s storage) ([]output, error) {
+		return collectPropensities(s, 3, 0)
+	}, 100},
+	{"stream propensities missing movie", func(s storage) ([]output, error) {
+		return collectPropensities(s, 20, 0)
+	}, 0},
+	{"top movies", func(s storage) ([]output, error) {
+		return sortedTopK(s.topMovies(5, 5))
+	}, 5},
+	{"top movies k over the number of movies", func(s storage) ([]output, error) {
+		return sortedTopK(s.topMovies(5, 50))
+	}, 20},
+	{"top movies k 0", func(s storage) ([]output, error) {
+		return sortedTopK(s.topMovies(5, 0))
+	}, 0},
+	{"top movies missing member", func(s storage) ([]output, error) {
+		return sortedTopK(s.topMovies(100, 5))
+	}, 0},
+	{"top members", func(s storage) ([]output, error) {
+		return sortedTopK(s.topMembers(3, 10))
+	}, 10},
+	{"top members k over the number of members", func(s storage) ([]output, error) {
+		return sortedTopK(s.topMembers(3, 500))
+	}, 100},
+	{"top members k 0", func(s storage) ([]output, error) {
+		return sortedTopK(s.topMembers(3, 0))
+	}, 0},
+	{"top members missing movie", func(s storage) ([]output, error) {
+		return sortedTopK(s.topMembers(20, 10))
+	}, 0},
+	{"scan members", func(s storage) ([]output, error) {
+		var vs []output
+		next := uint32(0)
+		err := s.scanMembers(func(id uint32, v vector) error {
+			if id != next {
+				return fmt.Errorf("scanned member %d, expected %d", id, next)
+			}
+			next++
+			vs = append(vs, elementOutputs(id, v)...)
+			return nil
+		})
+		return vs, err
+	}, 400},
+	{"scan members stops at the first error", func(s storage) ([]output, error) {
+		errStop := errors.New("stop")
+		calls := 0
+		err := s.scanMembers(func(id uint32, v vector) error {
+			calls++
+			return errStop
+		})
+		if err != errStop {
+			return nil, fmt.Errorf("expected the error from the callback, got %v", err)
+		}
+		if calls != 1 {
+			return nil, fmt.Errorf("the callback was called %d more times after it returned an error", calls-1)
+		}
+		return nil, nil
+	}, 0},
+	{"get movie", func(s storage) ([]output, error) {
+		w, err := s.getMovie(7)
+		return elementOutputs(7, w), err
+	}, 4},
+	{"get movie missing", func(s storage) ([]output, error) {
+		w, err := s.getMovie(20)
+		if w != nil {
+			return nil, fmt.Errorf("expected no vector for a missing movie, got %v", w)
+		}
+		return nil, err
+	}, 0},
+	// only checks the error, parallel scans may have scored any part of the members when it's returned
+	{"stream stops at the first error", func(s storage) ([]output, error) {
+		errStop := errors.New("stop")
+		calls := 0
+		err := s.streamPropensities(3, func(batch []output) error {
+			calls++
+			return errStop
+		})
+		if err != errStop {
+			return nil, fmt.Errorf("expected the error from the callback, got %v", err)
+		}
+		if calls != 1 {
+			return nil, fmt.Errorf("the callback was called %d more times after it returned an error", calls-1)
+		}
+		return nil, nil
+	}, 0},
+}
+
+// elementOutputs turns a vector into an output per element so it can be compared with diffOutputs,
+// the member is id and the movie is the element's index
+func elementOutputs(id uint32, v vector) []output {
+	vs := make([]output, len(v))
+	for d, x := range v {
+		vs[d] = output{id, uint32(d), x}
+	}
+	return vs
+}
+
+// sortedTopK checks the outputs of a top k query are best first, diffOutputs ignores the order
+func sortedTopK(vs []output, err error) ([]output, error) {
+	for i := 1; i < len(vs); i++ {
+		if worse(vs[i-1], vs[i]) {
+			return nil, fmt.Errorf("result %d is better than result %d", i, i-1)
+		}
+	}
+	return vs, err
+}
+
+// openConformanceBackend loads the conformance dataset into a fresh instance of the backend.
+// pg uses the docker-compose Postgres and is skipped if it isn't running.
+// opts may be nil to use the default backend options.
+func openConformanceBackend(t *testing.T, name string, opts *options) storage {
+	if opts == nil {
+		opts = defaultBackendOptions()
+	}
+	cfg := conformanceConfig
+	cfg.dir = t.TempDir()
+	cfg.encoding = opts.encoding
+	cfg.distribution = opts.distribution
+	opts.config = cfg
+	s, err := openBackend(name, opts)
+	if name == "pg" && err != nil {
+		t.Skipf("postgres isn't available, start it with `docker-compose up`: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.close(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	if pg, ok := s.(*pgstorage); ok {
+		if _, err := pg.db.Exec(context.Background(), "truncate members, movies"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.insertRandomMembers(cfg.members); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.insertRandomMovies(cfg.movies); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// defaultBackendOptions are the flag defaults of the backend specific options
+func defaultBackendOptions() *options {
+	return &options{sqliteJournalMode: "wal", flatAccess: "pread", parallelism: 1, badgerScan: "iterator", pgRank: "go"}
+}
+
+// The mem backend is the oracle, it's also checked against the generator in TestMemMatchesReference
+func TestConformance(t *testing.T) {
+	oracle, err := newMem(conformanceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range backendNames {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			runConformanceCases(t, oracle, openConformanceBackend(t, name, nil), 1e-12)
+		})
+	}
+
+	t.Run("flat mmap", func(t *testing.T) {
+		opts := defaultBackendOptions()
+		opts.flatAccess = "mmap"
+		runConformanceCases(t, oracle, openConformanceBackend(t, "flat", opts), 1e-12)
+	})
+
+	// more goroutines than there are members checks that the key ranges are split correctly
+	for _, parallelism := range []int{3, 200} {
+		for _, name := range []string{"pebble", "badger"} {
+			opts := defaultBackendOptions()
+			opts.parallelism = parallelism
+			name := name
+			t.Run(fmt.Sprintf("%s parallelism %d", name, parallelism), func(t *testing.T) {
+				runConformanceCases(t, oracle, openConformanceBackend(t, name, opts), 1e-12)
+			})
+		}
+	}
+	t.Run("pg sql rank", func(t *testing.T) {
+		opts := defaultBackendOptions()
+		opts.pgRank = "sql"
+		runConformanceCases(t, oracle, openConformanceBackend(t, "pg", opts), 1e-12)
+	})
+	t.Run("badger stream", func(t *testing.T) {
+		opts := defaultBackendOptions()
+		opts.parallelism = 3
+		opts.badgerScan = "stream"
+		runConformanceCases(t, oracle, openConformanceBackend(t, "badger", opts), 1e-12)
+	})
+
+	// lossy encodings should return the same outputs with propensities close to the oracle's
+	tolerances := map[encoding]float64{ENCODING_FLOAT32: 1e-6, ENCODING_INT8: 0.05}
+	for _, name := range []string{"badger", "pebble", "sqlite", "flat"} {
+		for _, e := range []encoding{ENCODING_FLOAT32, ENCODING_INT8} {
+			name, e := name, e
+			t.Run(name+" "+e.String(), func(t *testing.T) {
+				opts := defaultBackendOptions()
+				opts.encoding = e
+				runConformanceCases(t, oracle, openConformanceBackend(t, name, opts), tolerances[e])
+			})
+		}
+	}
+}
+
+// the other distributions are checked against an oracle generated with the same distribution
+func TestConformanceDistributions(t *testing.T) {
+	for i := range distributionNames {
+		d := distribution(i)
+		if d == DISTRIBUTION_UNIFORM {
+			continue
+		}
+		cfg := conformanceConfig
+		cfg.distribution = d
+		oracle, err := newMem(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"flat", "columnar"} {
+			name := name
+			t.Run(name+" "+d.String(), func(t *testing.T) {
+				opts := defaultBackendOptions()
+				opts.distribution = d
+				runConformanceCases(t, oracle, openConformanceBackend(t, name, opts), 1e-12)
+			})
+		}
+	}
+}
+
+// postgres ranking members itself has to return exactly what scoring the stream of
+// encoded members does, including for lossy encodings
+func TestPgRankSQLMatchesStream(t *testing.T) {
+	for _, e := range []encoding{ENCODING_FLOAT64, ENCODING_INT8} {
+		opts := defaultBackendOptions()
+		opts.pgRank = "sql"
+		opts.encoding = e
+		s := openConformanceBackend(t, "pg", opts)
+		for _, movie := range []uint32{0, 3, 19} {
+			expected, err := topMembersByStream(s, movie, 10, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, err := s.topMembers(movie, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range diffOutputs(expected, actual, 1e-12) {
+				t.Errorf("%s movie %d: %s", e, movie, m)
+			}
+		}
+	}
+}
+
+func runConformanceCases(t *testing.T, oracle storage, s storage, tolerance float64) {
+	for _, c := range conformanceCases {
+		t.Run(c.name, func(t *testing.T) {
+			expected, err := c.run(oracle)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(expected) != c.len {
+				t.Fatalf("the oracle returned %d results, expected %d", len(expected), c.len)
+			}
+
+			actual, err := c.run(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range diffOutputs(expected, actual, tolerance) {
+				t.Error(m)
+			}
+		})
+	}
+}
+
+func TestMemMatchesReference(t *testing.T) {
+	mem, err := newMem(conformanceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reference := newReference(conformanceConfig)
+	for _, c := range conformanceCases {
+		expected, err := c.run(reference)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := c.run(mem)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range diffOutputs(expected, actual, 0) {
+			t.Errorf("%s: %s", c.name, m)
+		}
+	}
+}
+
+// mem only generates the dataset once, when it's inserted or else on first use
+func TestMemGeneratesOnce(t *testing.T) {
+	mem, err := newMem(conformanceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mem.members != nil || mem.movies != nil {
+		t.Fatal("opening mem shouldn't generate the dataset")
+	}
+	if err := mem.insertRandomMembers(conformanceConfig.members); err != nil {
+		t.Fatal(err)
+	}
+	members := mem.members
+	if _, err := mem.query(makeRange(0, 10), makeRange(0, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if &mem.members[0] != &members[0] || len(mem.movies) != conformanceConfig.movies*conformanceConfig.dim {
+		t.Error("querying should keep the inserted members and only generate the movies")
+	}
+}
+
+// A query run without a load or warmup generates mem's dataset before the first timed query
+func TestPregenerateMem(t *testing.T) {
+	mem, err := newMem(conformanceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pregenerate(&annstorage{storage: mem})
+	if len(mem.members) != conformanceConfig.members*conformanceConfig.dim || len(mem.movies) != conformanceConfig.movies*conformanceConfig.dim {
+		t.Error("pregenerate should generate the dataset of a wrapped mem backend")
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Number of records read per pread when scanning
+const FLAT_SCAN_RECORDS = 4096
+
+// flatstorage stores members and movies as arrays of fixed size records in plain files,
+// the record for id is at offset id*recordSize. Member ids are dense so there is no
+// need for an index at all.
+type flatstorage struct {
+	members *flatfile
+	movies  *flatfile
+	cfg     config
+}
+
+// flatfile is a file of encoded vectors that are all the same dimension
+type flatfile struct {
+	path   string
+	access string
+	// dimension and encoding of the records when the file is empty
+	dim        int
+	encoding   encoding
+	f          *os.File
+	size       int64
+	recordSize int64
+	// the mapped file when access is "mmap"
+	data []byte
+}
+
+// access is either "pread" to read records with pread(2) or "mmap" to map the files into memory
+func newFlat(cfg config, access string) (*flatstorage, error) {
+	if access != "pread" && access != "mmap" {
+		return nil, fmt.Errorf("unknown flat file access mode %q", access)
+	}
+	members, err := openFlatfile(filepath.Join(cfg.dir, "flat_members"), access, cfg.dim, cfg.encoding)
+	if err != nil {
+		return nil, err
+	}
+	movies, err := openFlatfile(filepath.Join(cfg.dir, "flat_movies"), access, cfg.dim, cfg.encoding)
+	if err != nil {
+		members.close()
+		return nil, err
+	}
+	return &flatstorage{members, movies, cfg}, nil
+}
+
+func (*flatstorage) name() string {
+	return "flat"
+}
+
+// openFlatfile takes the record size from the header of the first record so a dataset
+// can be queried with different dim and encoding flags to the ones it was loaded with
+func openFlatfile(path string, access string, dim int, e encoding) (*flatfile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	ff := &flatfile{path: path, access: access, dim: dim, encoding: e, f: f, recordSize: int64(encodedLen(e, dim))}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	ff.size = info.Size()
+	if ff.size == 0 {
+		return ff, nil
+	}
+
+	header := make([]byte, HEADER_LEN)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	e, dim, err = decodeHeader(header)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	ff.recordSize = int64(encodedLen(e, dim))
+
+	if access == "mmap" {
+		ff.data, err = syscall.Mmap(int(f.Fd()), 0, int(ff.size), syscall.PROT_READ, syscall.MAP_SHARED)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to mmap %s: %v", path, err)
+		}
+	}
+	return ff, nil
+}
+
+func (ff *flatfile) len() int {
+	return int(ff.size / ff.recordSize)
+}
+
+// read returns the records [low, high), which must exist.
+// With mmap the returned bytes are the mapping itself, otherwise buf is reused if it's big enough.
+func (ff *flatfile) read(low, high int, buf []byte) ([]byte, error) {
+	start, end := int64(low)*ff.recordSize, int64(high)*ff.recordSize
+	if ff.data != nil {
+		return ff.data[start:end], nil
+	}
+	if int64(cap(buf)) < end-start {
+		buf = make([]byte, end-start)
+	}
+	buf = buf[:end-start]
+	if _, err := ff.f.ReadAt(buf, start); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (ff *flatfile) get(id uint32) (vector, error) {
+	if int(id) >= ff.len() {
+		return nil, nil
+	}
+	buf, err := ff.read(int(id), int(id)+1, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeVector(nil, buf)
+}
+
+// scan calls f with each record in [low, high) that exists, stopping at the first error f returns.
+// v is reused for the next record so f mustn't keep it.
+func (ff *flatfile) scan(low, high int, f func(id uint32, v vector) error) error {
+	if high > ff.len() {
+		high = ff.len()
+	}
+	var buf []byte
+	var v vector
+	for start := low; start < high; start += FLAT_SCAN_RECORDS {
+		end := start + FLAT_SCAN_RECORDS
+		if end > high {
+			end = high
+		}
+		var err error
+		buf, err = ff.read(start, end, buf)
+		if err != nil {
+			return err
+		}
+		for i := start; i < end; i++ {
+			offset := int64(i-start) * ff.recordSize
+			if v, err = decodeVector(v, buf[offset:offset+ff.recordSize]); err != nil {
+				return err
+			}
+			if err := f(uint32(i), v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// load replaces the contents of the file with the vectors [0, n)
+func (ff *flatfile) load(n int, vector func(id uint32) vector) error {
+	if err := ff.close(); err != nil {
+		return err
+	}
+
+	f, err := os.Create(ff.path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	var buf []byte
+	for i := 0; i < n; i++ {
+		buf = encodeVector(buf[:0], vector(uint32(i)), ff.encoding)
+		if _, err := w.Write(buf); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	reopened, err := openFlatfile(ff.path, ff.access, ff.dim, ff.encoding)
+	if err != nil {
+		return err
+	}
+	*ff = *reopened
+	return nil
+}
+
+func (ff *flatfile) close() error {
+	if ff.data != nil {
+		if err := syscall.Munmap(ff.data); err != nil {
+			return err
+		}
+		ff.data = nil
+	}
+	if ff.f == nil {
+		return nil
+	}
+	err := ff.f.Close()
+	ff.f = nil
+	return err
+}
+
+func (s *flatstorage) query(memberids []uint32, movieids []uint32) ([]output, error) {
+	memberids = distinct(memberids)
+	movieids = distinct(movieids)
+	movieVectors := make([]vector, len(movieids))
+	for i, movie := range movieids {
+		w, err := s.movies.get(movie)
+		if err != nil {
+			return nil, err
+		}
+		movieVectors[i] = w
+	}
+
+	vs := make([]output, 0, len(memberids)*len(movieids))
+	for _, member := range memberids {
+		v, err := s.members.get(member)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			continue
+		}
+		for i, w := range movieVectors {
+			if w != nil {
+				vs = append(vs, output{member, movieids[i], v.dot(w)})
+			}
+		}
+	}
+	return vs, nil
+}
+
+func (s *flatstorage) queryModel(memberids []uint32, models []MovieModel) ([]output, error) {
+	return scoreModels(memberids, models, s.members.get, s.movies.get)
+}
+
+// queryRange reads the range sequentially once and scores each member against every movie
+func (s *flatstorage) queryRange(low uint32, high uint32, movieids []uint32) ([]output, error) {
+	movieids = distinct(movieids)
+	movieVectors := make([]vector, 0, len(movieids))
+	found := make([]uint32, 0, len(movieids))
+	for _, movie := range movieids {
+		w, err := s.movies.get(movie)
+		if err != nil {
+			return nil, err
+		}
+		if w != nil {
+			found = append(found, movie)
+			movieVectors = append(movieVectors, w)
+		}
+	}
+
+	n := rangeLen(low, high, s.members.len())
+	vs := make([]output, 0, n*len(found))
+	err := s.members.scan(int(low), int(low)+n, func(member uint32, v vector) error {
+		for i, w := range movieVectors {
+			vs = append(vs, output{member, found[i], v.dot(w)})
+		}
+		return nil
+	})
+	return vs, err
+}
+
+func (s *flatstorage) memberPropensities(movie uint32) ([]output, error) {
+	w, err := s.movies.get(movie)
+	if err != nil || w == nil {
+		return nil, err
+	}
+
+	vs := make([]output, 0, s.members.len())
+	err = s.members.scan(0, s.members.len(), func(member uint32, v vector) error {
+		vs = append(vs, output{member, movie, v.dot(w)})
+		return nil
+	})
+	return vs, err
+}
+
+func (s *flatstorage) streamPropensities(movie uint32, f func([]output) error) error {
+	w, err := s.movies.get(movie)
+	if err != nil || w == nil {
+		return err
+	}
+
+	b := newBatcher(withProgress(s.name()+" member propensities", s.members.len(), f))
+	err = s.members.scan(0, s.members.len(), func(member uint32, v vector) error {
+		return b.add(output{member, movie, v.dot(w)})
+	})
+	if err != nil {
+		return err
+	}
+	return b.flush()
+}
+
+func (s *flatstorage) topMembers(movie uint32, k int) ([]output, error) {
+	return topMembersByStream(s, movie, k, s.cfg.members)
+}
+
+func (s *flatstorage) topMovies(member uint32, k int) ([]output, error) {
+	v, err := s.members.get(member)
+	if err != nil || v == nil {
+		return nil, err
+	}
+
+	top := newTopK(k, s.cfg.movies)
+	err = s.movies.scan(0, s.movies.len(), func(movie uint32, w vector) error {
+		top.add(output{member, movie, v.dot(w)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return top.sorted(), nil
+}
+
+func (s *flatstorage) getMovie(id uint32) (vector, error) {
+	return s.movies.get(id)
+}
+
+func (s *flatstorage) scanMembers(f func(id uint32, v vector) error) error {
+	return s.members.scan(0, s.members.len(), f)
+}
+
+func (s *flatstorage) insertRandomMembers(n int) error {
+	t, err := timed(func() error {
+		return s.members.load(n, s.cfg.generator().member)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	println(s.name(), "members insert time", t.Milliseconds())
+	return nil
+}
+
+func (s *flatstorage) insertRandomMovies(n int) error {
+	t, err := timed(func() error {
+		return s.movies.load(n, s.cfg.generator().movie)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	println(s.name(), "movie insert time", t.Milliseconds())
+	return nil
+}
+
+func (s *flatstorage) close() error {
+	if err := s.members.close(); err != nil {
+		return err
+	}
+	return s.movies.close()
+}
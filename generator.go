@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// distribution is how the elements of the generated vectors are spread
+type distribution uint8
+
+const (
+	// every element uniform in [0, 1)
+	DISTRIBUTION_UNIFORM distribution = iota
+	// members and movies drawn from a mixture of gaussians around shared cluster
+	// centers, which is closer to trained embeddings
+	DISTRIBUTION_GAUSSIAN
+	// the gaussian mixture scaled to unit length, as for cosine similarity
+	DISTRIBUTION_NORMALIZED
+	// the gaussian mixture with pareto distributed movie lengths, so a few popular
+	// movies have far higher propensities than the rest
+	DISTRIBUTION_POPULARITY
+)
+
+var distributionNames = []string{"uniform", "gaussian", "normalized", "popularity"}
+
+// Number of clusters in the gaussian mixture
+const GENERATOR_CLUSTERS = 32
+
+// Standard deviation of each element around its cluster center, the centers'
+// elements have a standard deviation of 1
+const GENERATOR_CLUSTER_SPREAD = 0.5
+
+// Shape of the pareto distribution of movie lengths in the popularity distribution,
+// lower is more skewed
+const GENERATOR_POPULARITY_SHAPE = 2.0
+
+func parseDistribution(name string) (distribution, error) {
+	for i, n := range distributionNames {
+		if n == name {
+			return distribution(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown distribution %q", name)
+}
+
+func (d distribution) String() string {
+	if int(d) < len(distributionNames) {
+		return distributionNames[d]
+	}
+	return fmt.Sprintf("distribution(%d)", d)
+}
+
+// generator deterministically produces the dataset from a seed so every backend
+// stores identical vectors, and any single vector can be regenerated from its id
+type generator struct {
+	seed         int64
+	dim          int
+	distribution distribution
+	// cluster centers of the gaussian mixture, nil for the uniform distribution
+	centers []vector
+}
+
+// Each kind of data gets its own stream so e.g. member 3 and movie 3 are unrelated
+const (
+	memberStream uint64 = iota + 1
+	movieStream
+	modelStream
+	clusterStream
+)
+
+// Number of movies per model is in [0, MAX_MODEL_SIZE)
+const MAX_MODEL_SIZE = 20
+
+func newGenerator(seed int64, dim int, d distribution) generator {
+	g := generator{seed: seed, dim: dim, distribution: d}
+	if d != DISTRIBUTION_UNIFORM {
+		g.centers = make([]vector, GENERATOR_CLUSTERS)
+		for i := range g.centers {
+			rng := g.rng(clusterStream, uint64(i))
+			g.centers[i] = make(vector, dim)
+			for j := range g.centers[i] {
+				g.centers[i][j] = rng.normal()
+			}
+		}
+	}
+	return g
+}
+
+func (g generator) member(id uint32) vector {
+	return g.vector(memberStream, id)
+}
+
+func (g generator) movie(id uint32) vector {
+	return g.vector(movieStream, id)
+}
+
+func (g generator) vector(stream uint64, id uint32) vector {
+	rng := g.rng(stream, uint64(id))
+	v := make(vector, g.dim)
+	if g.distribution == DISTRIBUTION_UNIFORM {
+		for i := range v {
+			v[i] = rng.float64()
+		}
+		return v
+	}
+
+	center := g.centers[rng.next()%uint64(len(g.centers))]
+	for i := range v {
+		v[i] = center[i] + GENERATOR_CLUSTER_SPREAD*rng.normal()
+	}
+	switch {
+	case g.distribution == DISTRIBUTION_NORMALIZED:
+		if norm := math.Sqrt(v.dot(v)); norm > 0 {
+			v.divAssign(norm)
+		}
+	case g.distribution == DISTRIBUTION_POPULARITY && stream == movieStream:
+		// 1 - float64 is in (0, 1] so the length is at least 1
+		v.divAssign(math.Pow(1-rng.float64(), 1/GENERATOR_POPULARITY_SHAPE))
+	}
+	return v
+}
+
+// models returns the same n models over nMovies movies on every call
+func (g generator) models(n int, nMovies int) []MovieModel {
+	rng := g.rng(modelStream, 0)
+	models := make([]MovieModel, n)
+	for i := range models {
+		movies := make([]uint32, rng.next()%MAX_MODEL_SIZE)
+		for j := range movies {
+			movies[j] = uint32(rng.next() % uint64(nMovies))
+		}
+		models[i] = MovieModel{movies}
+	}
+	return models
+}
+
+func (g generator) rng(stream uint64, id uint64) *splitmix64 {
+	state := splitmix64{uint64(g.seed)}
+	state = splitmix64{state.next() ^ stream}
+	state = splitmix64{state.next() ^ id}
+	return &splitmix64{state.next()}
+}
+
+// splitmix64 is a tiny, fast PRNG. Seeding math/rand's source is far too slow to do
+// once per vector when generating tens of millions of them.
+type splitmix64 struct {
+	state uint64
+}
+
+func (r *splitmix64) next() uint64 {
+	r.state += 0x9e3779b97f4a7c15
+	z := r.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// float64 returns a uniformly distributed float in [0, 1)
+func (r *splitmix64) float64() float64 {
+	return float64(r.next()>>11) / (1 << 53)
+}
+
+// normal returns a standard normally distributed float using the Box-Muller transform
+func (r *splitmix64) normal() float64 {
+	u := 1 - r.float64()
+	return math.Sqrt(-2*math.Log(u)) * math.Cos(2*math.Pi*r.float64())
+}
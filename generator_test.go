@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestGeneratorDeterministic(t *testing.T) {
+	for i := range distributionNames {
+		d := distribution(i)
+		g := newGenerator(42, 16, d)
+		if !reflect.DeepEqual(g.member(7), newGenerator(42, 16, d).member(7)) {
+			t.Errorf("%s: the same seed and id should generate the same member", d)
+		}
+		if !reflect.DeepEqual(g.movie(7), newGenerator(42, 16, d).movie(7)) {
+			t.Errorf("%s: the same seed and id should generate the same movie", d)
+		}
+		if reflect.DeepEqual(g.member(7), newGenerator(43, 16, d).member(7)) {
+			t.Errorf("%s: different seeds should generate different members", d)
+		}
+		if reflect.DeepEqual(g.member(7), g.member(8)) {
+			t.Errorf("%s: different ids should generate different members", d)
+		}
+		if reflect.DeepEqual(g.member(7), g.movie(7)) {
+			t.Errorf("%s: members and movies with the same id should be unrelated", d)
+		}
+		if !reflect.DeepEqual(g.models(15, 100), g.models(15, 100)) {
+			t.Errorf("%s: models should be the same on every call", d)
+		}
+	}
+}
+
+func TestGeneratorDistributions(t *testing.T) {
+	const n = 10_000
+	norm := func(v vector) float64 { return math.Sqrt(v.dot(v)) }
+
+	normalized := newGenerator(1, 16, DISTRIBUTION_NORMALIZED)
+	for id := uint32(0); id < n; id++ {
+		if l := norm(normalized.member(id)); math.Abs(l-1) > 1e-12 {
+			t.Fatalf("normalized member %d has length %g", id, l)
+		}
+	}
+
+	// the mixture is centered around 0, unlike the uniform distribution
+	gaussian := newGenerator(1, 16, DISTRIBUTION_GAUSSIAN)
+	negative := 0
+	for id := uint32(0); id < n; id++ {
+		for _, x := range gaussian.member(id) {
+			if x < 0 {
+				negative++
+			}
+		}
+	}
+	if negative < n*16/4 || negative > n*16*3/4 {
+		t.Errorf("%d of %d gaussian elements are negative", negative, n*16)
+	}
+
+	// popularity only changes the movie lengths, by a factor of at least 1
+	popularity := newGenerator(1, 16, DISTRIBUTION_POPULARITY)
+	if !reflect.DeepEqual(popularity.member(3), gaussian.member(3)) {
+		t.Error("popularity members should be the same as gaussian members")
+	}
+	var factors []float64
+	for id := uint32(0); id < n; id++ {
+		factor := norm(popularity.movie(id)) / norm(gaussian.movie(id))
+		if factor < 1-1e-12 {
+			t.Fatalf("movie %d was shortened by a factor of %g", id, factor)
+		}
+		factors = append(factors, factor)
+	}
+	sort.Float64s(factors)
+	if median, max := factors[n/2], factors[n-1]; max < 10*median {
+		t.Errorf("the most popular movie is only %g times longer than the median", max/median)
+	}
+}
+
+func TestParseDistribution(t *testing.T) {
+	for i, name := range distributionNames {
+		if d, err := parseDistribution(name); err != nil || d != distribution(i) || d.String() != name {
+			t.Errorf("%s parsed as %v, %v", name, d, err)
+		}
+	}
+	if _, err := parseDistribution("zipf"); err == nil {
+		t.Error("parsing an unknown distribution should fail")
+	}
+}
+
+func TestGeneratorRanges(t *testing.T) {
+	g := newGenerator(1, 16, DISTRIBUTION_UNIFORM)
+	for id := uint32(0); id < 1000; id++ {
+		v := g.member(id)
+		if len(v) != 16 {
+			t.Fatalf("expected dim 16, got %d", len(v))
+		}
+		for _, x := range v {
+			if x < 0 || x >= 1 {
+				t.Fatalf("member %d has element %f outside [0, 1)", id, x)
+			}
+		}
+	}
+
+	for _, model := range g.models(100, 25) {
+		if len(model.movies) >= MAX_MODEL_SIZE {
+			t.Errorf("model has %d movies", len(model.movies))
+		}
+		for _, movie := range model.movies {
+			if movie >= 25 {
+				t.Errorf("model contains movie %d which is out of range", movie)
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// histogram records every sample so percentiles are exact, the number of
+// iterations per workload is small enough that this doesn't matter
+type histogram struct {
+	// samples in the order they were recorded
+	samples []time.Duration
+	// sorted copy of samples, nil when it needs to be recomputed
+	sorted []time.Duration
+}
+
+type latencySummary struct {
+	count  int
+	min    time.Duration
+	max    time.Duration
+	mean   time.Duration
+	stddev time.Duration
+	p50    time.Duration
+	p90    time.Duration
+	p99    time.Duration
+	p999   time.Duration
+}
+
+func newHistogram(capacity int) *histogram {
+	return &histogram{samples: make([]time.Duration, 0, capacity)}
+}
+
+func (h *histogram) record(d time.Duration) {
+	h.samples = append(h.samples, d)
+	h.sorted = nil
+}
+
+func (h *histogram) sortedSamples() []time.Duration {
+	if h.sorted == nil {
+		h.sorted = append([]time.Duration{}, h.samples...)
+		sort.Slice(h.sorted, func(i, j int) bool { return h.sorted[i] < h.sorted[j] })
+	}
+	return h.sorted
+}
+
+// percentile uses the nearest-rank method, p is in [0, 100]
+func (h *histogram) percentile(p float64) time.Duration {
+	if len(h.samples) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(h.samples))))
+	if rank < 1 {
+		rank = 1
+	}
+	return h.sortedSamples()[rank-1]
+}
+
+func (h *histogram) mean() float64 {
+	if len(h.samples) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, d := range h.samples {
+		sum += float64(d)
+	}
+	return sum / float64(len(h.samples))
+}
+
+// stddev is the sample standard deviation
+func (h *histogram) stddev() float64 {
+	if len(h.samples) < 2 {
+		return 0
+	}
+	mean := h.mean()
+	sum := 0.0
+	for _, d := range h.samples {
+		sum += (float64(d) - mean) * (float64(d) - mean)
+	}
+	return math.Sqrt(sum / float64(len(h.samples)-1))
+}
+
+func (h *histogram) summary() latencySummary {
+	if len(h.samples) == 0 {
+		return latencySummary{}
+	}
+	sorted := h.sortedSamples()
+	return latencySummary{
+		count:  len(sorted),
+		min:    sorted[0],
+		max:    sorted[len(sorted)-1],
+		mean:   time.Duration(h.mean()),
+		stddev: time.Duration(h.stddev()),
+		p50:    h.percentile(50),
+		p90:    h.percentile(90),
+		p99:    h.percentile(99),
+		p999:   h.percentile(99.9),
+	}
+}
+
+func (s latencySummary) String() string {
+	ms := func(d time.Duration) string {
+		return fmt.Sprintf("%.2fms", float64(d)/float64(time.Millisecond))
+	}
+	return fmt.Sprintf("n=%d mean=%s stddev=%s p50=%s p90=%s p99=%s p999=%s max=%s",
+		s.count, ms(s.mean), ms(s.stddev), ms(s.p50), ms(s.p90), ms(s.p99), ms(s.p999), ms(s.max))
+}
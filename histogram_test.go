@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistogramSummary(t *testing.T) {
+	h := newHistogram(100)
+	// record 100..1 so the histogram has to sort
+	for i := 100; i > 0; i-- {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+
+	s := h.summary()
+	expected := map[string][2]time.Duration{
+		"min":  {s.min, time.Millisecond},
+		"max":  {s.max, 100 * time.Millisecond},
+		"mean": {s.mean, 50500 * time.Microsecond},
+		"p50":  {s.p50, 50 * time.Millisecond},
+		"p90":  {s.p90, 90 * time.Millisecond},
+		"p99":  {s.p99, 99 * time.Millisecond},
+		"p999": {s.p999, 100 * time.Millisecond},
+	}
+	for name, x := range expected {
+		if x[0] != x[1] {
+			t.Errorf("%s: expected %v, got %v", name, x[1], x[0])
+		}
+	}
+	if s.count != 100 {
+		t.Errorf("count: expected 100, got %d", s.count)
+	}
+	// the sample stddev of 1..100 is ~29.01
+	if s.stddev < 29*time.Millisecond || s.stddev > 29020*time.Microsecond {
+		t.Errorf("stddev: got %v", s.stddev)
+	}
+}
+
+func TestHistogramEmpty(t *testing.T) {
+	if s := newHistogram(0).summary(); s != (latencySummary{}) {
+		t.Errorf("expected an empty summary, got %v", s)
+	}
+}
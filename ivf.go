@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Maximum number of members the centroids are trained on
+const IVF_TRAIN_SAMPLE = 50_000
+
+// Number of rounds of Lloyd's algorithm when training the centroids
+const IVF_KMEANS_ITERATIONS = 10
+
+// Identifies index files and the version of their layout
+const IVF_MAGIC = "IVF2"
+
+// ivfindex is an inverted file index: the members are clustered around centroids
+// with k-means and a query only scores the members in the lists of the centroids
+// with the highest propensities. Each list keeps a copy of its members' vectors so
+// a query doesn't need any lookups in the backend.
+type ivfindex struct {
+	dataset   ivfdataset
+	dim       int
+	centroids []vector
+	lists     []ivflist
+}
+
+// ivfdataset identifies the dataset an index was built from, an index of a different
+// dataset would return ids and propensities that don't match the backend
+type ivfdataset struct {
+	seed         int64
+	members      int
+	dim          int
+	distribution distribution
+	encoding     encoding
+}
+
+func newIVFDataset(cfg config) ivfdataset {
+	return ivfdataset{cfg.seed, cfg.members, cfg.dim, cfg.distribution, cfg.encoding}
+}
+
+func (d ivfdataset) String() string {
+	return fmt.Sprintf("%d %s members of dimension %d with seed %d encoded as %s", d.members, d.distribution, d.dim, d.seed, d.encoding)
+}
+
+type ivflist struct {
+	ids []uint32
+	// vectors of ids back to back, ids[i] is at [i*dim, (i+1)*dim)
+	vectors []float64
+}
+
+func ivfPath(dir string, backend string) string {
+	return filepath.Join(dir, "ivf_"+backend)
+}
+
+// buildIVF trains nlist centroids on a sample of the members of s and then assigns
+// every member to its nearest centroid, so it reads the members twice
+func buildIVF(s storage, cfg config, nlist int) (*ivfindex, error) {
+	// reservoir sampling as backends don't support reading random members
+	r := rand.New(rand.NewSource(cfg.seed))
+	sample := make([]vector, 0, IVF_TRAIN_SAMPLE)
+	seen := 0
+	err := s.scanMembers(func(id uint32, v vector) error {
+		if len(sample) > 0 {
+			if err := checkDims(v, len(sample[0])); err != nil {
+				return err
+			}
+		}
+		seen++
+		if len(sample) < IVF_TRAIN_SAMPLE {
+			sample = append(sample, append(vector(nil), v...))
+		} else if i := r.Intn(seen); i < IVF_TRAIN_SAMPLE {
+			sample[i] = append(sample[i][:0], v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(sample) == 0 {
+		return nil, fmt.Errorf("%s has no members to index", s.name())
+	}
+
+	index := &ivfindex{dataset: newIVFDataset(cfg), dim: len(sample[0]), centroids: kmeans(sample, nlist, r)}
+	index.lists = make([]ivflist, len(index.centroids))
+	err = s.scanMembers(func(id uint32, v vector) error {
+		if err := checkDims(v, index.dim); err != nil {
+			return err
+		}
+		list := &index.lists[nearest(index.centroids, v)]
+		list.ids = append(list.ids, id)
+		list.vectors = append(list.vectors, v...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// kmeans clusters the points into at most k clusters starting from k random points
+func kmeans(points []vector, k int, r *rand.Rand) []vector {
+	if k > len(points) {
+		k = len(points)
+	}
+	if k < 1 {
+		k = 1
+	}
+	centroids := make([]vector, k)
+	for i, p := range r.Perm(len(points))[:k] {
+		centroids[i] = append(vector(nil), points[p]...)
+	}
+
+	dim := len(points[0])
+	sums := make([]vector, k)
+	counts := make([]int, k)
+	for iteration := 0; iteration < IVF_KMEANS_ITERATIONS; iteration++ {
+		for i := range sums {
+			sums[i] = make(vector, dim)
+			counts[i] = 0
+		}
+		for _, p := range points {
+			c := nearest(centroids, p)
+			sums[c].addAssign(p)
+			counts[c]++
+		}
+		// a centroid that lost all its points keeps its position
+		for i := range centroids {
+			if counts[i] > 0 {
+				sums[i].divAssign(float64(counts[i]))
+				centroids[i] = sums[i]
+			}
+		}
+	}
+	return centroids
+}
+
+// nearest returns the index of the centroid closest to v by euclidean distance
+func nearest(centroids []vector, v vector) int {
+	best, bestDistance := 0, math.Inf(1)
+	for i, c := range centroids {
+		distance := 0.0
+		for d := range c {
+			diff := c[d] - v[d]
+			distance += diff * diff
+		}
+		if distance < bestDistance {
+			best, bestDistance = i, distance
+		}
+	}
+	return best
+}
+
+// search returns the approximate top k members for the movie vector w by scoring the
+// members in the probes lists whose centroids have the highest propensities
+func (index *ivfindex) search(movie uint32, w vector, k int, probes int) []output {
+	order := make([]int, len(index.centroids))
+	scores := make([]float64, len(index.centroids))
+	for i, c := range index.centroids {
+		order[i] = i
+		scores[i] = c.dot(w)
+	}
+	sort.Slice(order, func(i, j int) bool { return scores[order[i]] > scores[order[j]] })
+	if probes > len(order) {
+		probes = len(order)
+	}
+
+	top := newTopK(k, index.size())
+	for _, l := range order[:probes] {
+		list := index.lists[l]
+		for i, id := range list.ids {
+			v := vector(list.vectors[i*index.dim : (i+1)*index.dim])
+			top.add(output{id, movie, v.dot(w)})
+		}
+	}
+	return top.sorted()
+}
+
+// size is the number of members in the index
+func (index *ivfindex) size() int {
+	n := 0
+	for _, list := range index.lists {
+		n += len(list.ids)
+	}
+	return n
+}
+
+// write saves the index as little endian: the magic, the dataset's seed as a uint64 and
+// its members, dim, distribution and encoding as uint32s, the index's dim and number of
+// lists as uint32s, the centroids, then each list's length, ids and vectors
+func (index *ivfindex) write(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	buf := make([]byte, 8)
+	putUint32 := func(x uint32) {
+		binary.LittleEndian.PutUint32(buf, x)
+		w.Write(buf[:4])
+	}
+	putFloat64s := func(xs []float64) {
+		for _, x := range xs {
+			binary.LittleEndian.PutUint64(buf, math.Float64bits(x))
+			w.Write(buf)
+		}
+	}
+
+	// bufio.Writer keeps the first error, so it's only checked by Flush
+	w.WriteString(IVF_MAGIC)
+	binary.LittleEndian.PutUint64(buf, uint64(index.dataset.seed))
+	w.Write(buf)
+	putUint32(uint32(index.dataset.members))
+	putUint32(uint32(index.dataset.dim))
+	putUint32(uint32(index.dataset.distribution))
+	putUint32(uint32(index.dataset.encoding))
+	putUint32(uint32(index.dim))
+	putUint32(uint32(len(index.centroids)))
+	for _, c := range index.centroids {
+		putFloat64s(c)
+	}
+	for _, list := range index.lists {
+		putUint32(uint32(len(list.ids)))
+		for _, id := range list.ids {
+			putUint32(id)
+		}
+		putFloat64s(list.vectors)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readIVF(path string) (*ivfindex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	buf := make([]byte, 8)
+	magic := make([]byte, len(IVF_MAGIC))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != IVF_MAGIC {
+		return nil, fmt.Errorf("%s isn't an ivf index", path)
+	}
+	readUint32 := func() (uint32, error) {
+		_, err := io.ReadFull(r, buf[:4])
+		return binary.LittleEndian.Uint32(buf), err
+	}
+	readFloat64s := func(n int) ([]float64, error) {
+		xs := make([]float64, n)
+		for i := range xs {
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return nil, err
+			}
+			xs[i] = math.Float64frombits(binary.LittleEndian.Uint64(buf))
+		}
+		return xs, nil
+	}
+
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	dataset := ivfdataset{seed: int64(binary.LittleEndian.Uint64(buf))}
+	var header [6]uint32
+	for i := range header {
+		if header[i], err = readUint32(); err != nil {
+			return nil, err
+		}
+	}
+	dataset.members = int(header[0])
+	dataset.dim = int(header[1])
+	dataset.distribution = distribution(header[2])
+	dataset.encoding = encoding(header[3])
+	dim, nlist := header[4], header[5]
+	index := &ivfindex{dataset: dataset, dim: int(dim), centroids: make([]vector, nlist), lists: make([]ivflist, nlist)}
+	for i := range index.centroids {
+		if index.centroids[i], err = readFloat64s(index.dim); err != nil {
+			return nil, err
+		}
+	}
+	for i := range index.lists {
+		n, err := readUint32()
+		if err != nil {
+			return nil, err
+		}
+		list := &index.lists[i]
+		list.ids = make([]uint32, n)
+		for j := range list.ids {
+			if list.ids[j], err = readUint32(); err != nil {
+				return nil, err
+			}
+		}
+		if list.vectors, err = readFloat64s(int(n) * index.dim); err != nil {
+			return nil, err
+		}
+	}
+	return index, nil
+}
+
+// recall is the fraction of the exact top k that's in the approximate top k
+func recall(exact, approximate []output) float64 {
+	if len(exact) == 0 {
+		return 1
+	}
+	found := make(map[uint32]bool, len(approximate))
+	for _, o := range approximate {
+		found[o.member] = true
+	}
+	n := 0
+	for _, o := range exact {
+		if found[o.member] {
+			n++
+		}
+	}
+	return float64(n) / float64(len(exact))
+}
+
+// annstorage answers topMembers approximately from an IVF index of the wrapped backend
+type annstorage struct {
+	storage
+	index  *ivfindex
+	probes int
+}
+
+// openANN reads the index of s built by runIndex, which has to be of the dataset in cfg
+func openANN(s storage, cfg config, probes int) (*annstorage, error) {
+	index, err := readIVF(ivfPath(cfg.dir, s.name()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the ivf index of %s, build it with storage-perf index: %v", s.name(), err)
+	}
+	if expected := newIVFDataset(cfg); index.dataset != expected || index.dim != cfg.dim {
+		return nil, fmt.Errorf("the ivf index of %s is of %s, not %s, rebuild it with storage-perf index", s.name(), index.dataset, expected)
+	}
+	return &annstorage{s, index, probes}, nil
+}
+
+func (s *annstorage) name() string {
+	return s.storage.name() + "-ivf"
+}
+
+func (s *annstorage) topMembers(movie uint32, k int) ([]output, error) {
+	w, err := s.getMovie(movie)
+	if err != nil || w == nil {
+		return nil, err
+	}
+	return s.index.search(movie, w, k, s.probes), nil
+}
+
+// runIndex builds an IVF index over the members of each backend, saves it next to the
+// backend's data and measures the recall and latency of topMembers against the exact scan
+func runIndex(args []string) error {
+	opts, err := parseOptions("index", args)
+	if err != nil {
+		return err
+	}
+	// the index is built from and compared against the exact scan of the backend itself
+	if opts.ann {
+		return fmt.Errorf("-ann can't be used when building the index")
+	}
+
+	return withBackends(opts, func(backend storage) error {
+		var index *ivfindex
+		t, err := timed(func() (err error) {
+			index, err = buildIVF(backend, opts.config, opts.ivfLists)
+			if err != nil {
+				return err
+			}
+			return index.write(ivfPath(opts.dir, backend.name()))
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-8s built an index of %d members in %d lists in %dms\n", backend.name(), index.size(), len(index.lists), t.Milliseconds())
+
+		// the exact results are the same for every number of probes
+		movies := makeRange(0, uint32(opts.movieQuerySize))
+		exact := make([][]output, len(movies))
+		var exactTime time.Duration
+		for i, movie := range movies {
+			t, err := timed(func() (err error) {
+				exact[i], err = backend.topMembers(movie, opts.topK)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			exactTime += t
+		}
+		fmt.Printf("%-8s exact       top %d mean=%s\n", backend.name(), opts.topK, fmtMs(int64(exactTime)/int64(len(movies))))
+
+		for probes := 1; ; probes *= 2 {
+			if probes > len(index.lists) {
+				probes = len(index.lists)
+			}
+			ann := &annstorage{backend, index, probes}
+			var total float64
+			var annTime time.Duration
+			for i, movie := range movies {
+				var approximate []output
+				t, err := timed(func() (err error) {
+					approximate, err = ann.topMembers(movie, opts.topK)
+					return err
+				})
+				if err != nil {
+					return err
+				}
+				annTime += t
+				total += recall(exact[i], approximate)
+			}
+			fmt.Printf("%-8s probes=%-4d recall@%d=%.3f mean=%s\n",
+				backend.name(), probes, opts.topK, total/float64(len(movies)), fmtMs(int64(annTime)/int64(len(movies))))
+			if probes == len(index.lists) {
+				return nil
+			}
+		}
+	})
+}
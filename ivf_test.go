@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+var ivfConfig = config{members: 2000, movies: 20, dim: 4, seed: 7}
+
+func buildTestIVF(t *testing.T) (*memstorage, *ivfindex) {
+	s, err := newMem(ivfConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := buildIVF(s, ivfConfig, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.size() != ivfConfig.members || len(index.lists) != 16 {
+		t.Fatalf("indexed %d members in %d lists, expected %d in 16", index.size(), len(index.lists), ivfConfig.members)
+	}
+	return s, index
+}
+
+// Probing every list scores every member so it has to match the exact scan
+func TestIVFAllProbesIsExact(t *testing.T) {
+	s, index := buildTestIVF(t)
+	ann := &annstorage{s, index, len(index.lists)}
+	for movie := uint32(0); movie < 5; movie++ {
+		for _, k := range []int{0, 1, 10, 3000} {
+			exact, err := s.topMembers(movie, k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			approximate, err := ann.topMembers(movie, k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range diffOutputs(exact, approximate, 1e-9) {
+				t.Errorf("movie %d top %d: %s", movie, k, m)
+			}
+		}
+	}
+	if vs, err := ann.topMembers(20, 10); err != nil || len(vs) != 0 {
+		t.Errorf("a missing movie should have no top members, got %v, %v", vs, err)
+	}
+}
+
+// Recall can only improve with more probes and a few probes should already find most of the top k
+func TestIVFRecall(t *testing.T) {
+	s, index := buildTestIVF(t)
+	previous := 0.0
+	for _, probes := range []int{1, 4, 16} {
+		total := 0.0
+		for movie := uint32(0); movie < 10; movie++ {
+			exact, _ := s.topMembers(movie, 10)
+			total += recall(exact, index.search(movie, s.get(s.movies, movie), 10, probes))
+		}
+		r := total / 10
+		if r < previous {
+			t.Errorf("recall with %d probes is %.3f, lower than %.3f with fewer", probes, r, previous)
+		}
+		previous = r
+	}
+	if previous != 1 {
+		t.Errorf("recall with every list probed is %.3f, expected 1", previous)
+	}
+}
+
+func TestIVFWriteRead(t *testing.T) {
+	s, index := buildTestIVF(t)
+	path := filepath.Join(t.TempDir(), "ivf")
+	if err := index.write(path); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readIVF(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.dataset != index.dataset {
+		t.Errorf("read the dataset %s, expected %s", read.dataset, index.dataset)
+	}
+	for movie := uint32(0); movie < 5; movie++ {
+		w := s.get(s.movies, movie)
+		for _, m := range diffOutputs(index.search(movie, w, 10, 2), read.search(movie, w, 10, 2), 0) {
+			t.Errorf("movie %d: %s", movie, m)
+		}
+	}
+
+	if _, err := readIVF(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("reading a missing index should fail")
+	}
+}
+
+// An index left over from loading a different dataset has to be rebuilt
+func TestOpenANNRejectsOtherDatasets(t *testing.T) {
+	s, index := buildTestIVF(t)
+	cfg := ivfConfig
+	cfg.dir = t.TempDir()
+	if err := index.write(ivfPath(cfg.dir, s.name())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openANN(s, cfg, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := map[string]func(*config){
+		"seed":         func(cfg *config) { cfg.seed++ },
+		"members":      func(cfg *config) { cfg.members-- },
+		"dim":          func(cfg *config) { cfg.dim = 3 },
+		"distribution": func(cfg *config) { cfg.distribution = DISTRIBUTION_GAUSSIAN },
+		"encoding":     func(cfg *config) { cfg.encoding = ENCODING_INT8 },
+	}
+	for name, change := range changes {
+		other := cfg
+		change(&other)
+		if _, err := openANN(s, other, 1); err == nil {
+			t.Errorf("opening an index with a different %s should fail", name)
+		}
+	}
+}
+
+func TestKmeansFewerPointsThanClusters(t *testing.T) {
+	points := []vector{{0, 0}, {1, 1}, {2, 2}}
+	centroids := kmeans(points, 10, rand.New(rand.NewSource(1)))
+	if len(centroids) != len(points) {
+		t.Errorf("got %d centroids for %d points", len(centroids), len(points))
+	}
+}
@@ -1,20 +1,67 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"os"
 	"time"
 )
 
+// Default dataset and query sizes, these can be overridden with flags
 const N_MEMBERS = 50_000_000
 const N_MOVIES = 25_000
 
-// Number of elements in each vector
+// Default number of elements in each vector
 const K = 10
 
+// Default seed of the generated dataset
+const SEED = 1
+
 const MOVIE_QUERY_SIZE = 10
 const MODEL_QUERY_SIZE = 15
 const MEMBER_QUERY_SIZE = 10000
 
+// Default number of results of the top k scenarios
+const TOP_K = 10
+
+// config holds the sizes of the dataset and of each query
+type config struct {
+	members         int
+	movies          int
+	dim             int
+	seed            int64
+	movieQuerySize  int
+	modelQuerySize  int
+	memberQuerySize int
+	// how the generated vectors are spread
+	distribution distribution
+	// how the backends that store encoded vectors encode them when loading
+	encoding encoding
+	// number of results of the top k scenarios
+	topK int
+
+	// directory the embedded backends store their data in
+	dir string
+}
+
+func (cfg config) generator() generator {
+	return newGenerator(cfg.seed, cfg.dim, cfg.distribution)
+}
+
+func defaultConfig() config {
+	return config{
+		members:         N_MEMBERS,
+		movies:          N_MOVIES,
+		dim:             K,
+		seed:            SEED,
+		dir:             ".",
+		movieQuerySize:  MOVIE_QUERY_SIZE,
+		modelQuerySize:  MODEL_QUERY_SIZE,
+		memberQuerySize: MEMBER_QUERY_SIZE,
+		topK:            TOP_K,
+	}
+}
+
 type MovieModel struct {
 	movies []uint32
 }
@@ -23,161 +70,252 @@ type storage interface {
 	name() string
 	query(memberids []uint32, movieids []uint32) ([]output, error)
 	queryModel(memberids []uint32, models []MovieModel) ([]output, error)
+	// memberPropensities returns the propensity of every member for movie, which holds
+	// an output per member in memory, see streamPropensities for large datasets
 	memberPropensities(movie uint32) ([]output, error)
+	// streamPropensities scores every member against movie, passing the outputs to f
+	// in batches so the whole population can be scored in bounded memory. The batch
+	// is only valid until f returns and the stream stops at the first error from f.
+	streamPropensities(movie uint32, f func([]output) error) error
+	// topMovies scores member against every movie and returns the k best, best first
+	topMovies(member uint32, k int) ([]output, error)
+	// topMembers scores every member against movie and returns the k best, best first
+	topMembers(movie uint32, k int) ([]output, error)
+	// getMovie returns the vector of movie, or nil if there is no such movie
+	getMovie(id uint32) (vector, error)
+	// scanMembers calls f with every member's vector in id order. v is only valid
+	// until f returns and the scan stops at the first error from f.
+	scanMembers(f func(id uint32, v vector) error) error
 	queryRange(low uint32, high uint32, movieids []uint32) ([]output, error)
 	insertRandomMembers(n int) error
 	insertRandomMovies(n int) error
+	close() error
 }
 
-// Uncomment `insert`s to run the insertion code once as it's pretty slow
+const usage = `usage: storage-perf <command> [flags]
+
+commands:
+  load       insert the random dataset into each backend
+  query      run the query workloads against each backend
+  bench      load and then query each backend
+  verify     check the results of each backend against a reference computation
+  compare    compare two JSON reports and fail if a scenario regressed
+  index      build an IVF index over the members of each backend and measure its recall
+  precision  compare the size on disk and propensity error of each vector encoding
+
+Run storage-perf <command> -h to see the flags of a command.
+`
+
 func main() {
-	// pebble, err := newPebble()
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
-	// if err := insert(pebble); err != nil {
-	// 	log.Fatal(err)
-	// }
-
-	// badger, err := newBadger()
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
-	// if err := insert(badger); err != nil {
-	// 	log.Fatal(err)
-	// }
-
-	pg, err := newPg()
-	if err != nil {
-		log.Fatal(err)
-	}
-	// if err := insert(pg); err != nil {
-	// 	log.Fatal(err)
-	// }
-
-	// _ = pebble
-	// _ = pg
-	// _ = badger
-	backends := []storage{
-		// badger,
-		pg,
-		// pebble,
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
 	}
 
-	for _, backend := range backends {
-		if err := query(backend); err != nil {
-			log.Fatal(err)
-		}
-		if err := queryModels(backend); err != nil {
-			log.Fatal(err)
-		}
-		if err := queryRange(backend); err != nil {
-			log.Fatal(err)
-		}
+	cmd, args := os.Args[1], os.Args[2:]
+	var err error
+	switch cmd {
+	case "load":
+		err = runLoad(args)
+	case "query":
+		err = runQuery(args)
+	case "bench":
+		err = runBench(args)
+	case "verify":
+		err = runVerify(args)
+	case "compare":
+		err = runCompare(args)
+	case "index":
+		err = runIndex(args)
+	case "precision":
+		err = runPrecision(args)
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stderr, usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
 
-		// if err := queryMemberPropensities(backend); err != nil {
-		// 	log.Fatal(err)
-		// }
+	if err != nil {
+		log.Fatal(err)
+	}
+}
 
-		println(backend.name(), "done")
-		time.Sleep(time.Second * 2)
+func runLoad(args []string) error {
+	opts, err := parseOptions("load", args)
+	if err != nil {
+		return err
 	}
+	r := newReport("load", opts)
+	err = withBackends(opts, func(backend storage) error {
+		return load(backend, opts, r)
+	})
+	return r.finish(opts, err)
+}
 
+func runQuery(args []string) error {
+	opts, err := parseOptions("query", args)
+	if err != nil {
+		return err
+	}
+	r := newReport("query", opts)
+	err = withBackends(opts, func(backend storage) error {
+		return runWorkloads(backend, opts, r)
+	})
+	return r.finish(opts, err)
 }
 
-func insert(s storage) error {
-	t, err := timed(func() error {
-		if err := s.insertRandomMembers(N_MEMBERS); err != nil {
-			return err
-		}
-		if err := s.insertRandomMovies(N_MOVIES); err != nil {
+func runBench(args []string) error {
+	opts, err := parseOptions("bench", args)
+	if err != nil {
+		return err
+	}
+	r := newReport("bench", opts)
+	err = withBackends(opts, func(backend storage) error {
+		if err := load(backend, opts, r); err != nil {
 			return err
 		}
-		return nil
+		return runWorkloads(backend, opts, r)
 	})
+	return r.finish(opts, err)
+}
 
+// load inserts the dataset and records the insert time as the "load" scenario
+func load(backend storage, opts *options, r *report) error {
+	t, err := insert(backend, opts.config)
 	if err != nil {
 		return err
 	}
-
-	println(s.name(), "insert time", t.Milliseconds())
+	h := newHistogram(1)
+	h.record(t)
+	r.add(backend.name(), "load", opts.members+opts.movies, h)
 	return nil
 }
 
-func queryModels(s storage) error {
-	t, err := timed(func() error {
-		members := makeRange(0, MEMBER_QUERY_SIZE)
-		models := randomModels()
-		data, err := s.queryModel(members, models)
+func runWorkloads(backend storage, opts *options, r *report) error {
+	pregenerate(backend)
+	for _, w := range opts.workloads {
+		h, n, err := benchmark(backend, w, opts)
+		if err != nil {
+			return fmt.Errorf("%s %s: %v", backend.name(), w.name, err)
+		}
+		fmt.Printf("%-8s %-14s %s\n", backend.name(), w.name, h.summary())
+		r.add(backend.name(), w.name, n, h)
+	}
+	println(backend.name(), "done")
+	return nil
+}
 
-		expectedLen := MEMBER_QUERY_SIZE * MODEL_QUERY_SIZE
-		if len(data) != expectedLen {
-			log.Fatalf("%s wrong number of model query results: expected %d, got %d", s.name(), expectedLen, len(data))
+// benchmark runs the workload opts.warmup times without recording and then
+// records the latency of opts.iterations further runs.
+// It also returns the number of results of the last run.
+func benchmark(backend storage, w workload, opts *options) (*histogram, int, error) {
+	for i := 0; i < opts.warmup; i++ {
+		if _, err := w.run(backend, opts.config); err != nil {
+			return nil, 0, err
 		}
-		return err
-	})
+	}
 
-	if err != nil {
-		return err
+	h := newHistogram(opts.iterations)
+	n := 0
+	for i := 0; i < opts.iterations; i++ {
+		t, err := timed(func() error {
+			var err error
+			n, err = w.run(backend, opts.config)
+			return err
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		h.record(t)
 	}
+	return h, n, nil
+}
 
-	println(s.name(), "query models time:", t.Milliseconds())
+// withBackends opens each selected backend in turn, runs f against it and closes it again
+// so only one engine is using the machine at a time
+func withBackends(opts *options, f func(storage) error) error {
+	for i, name := range opts.backends {
+		if i > 0 {
+			time.Sleep(time.Second * 2)
+		}
+
+		backend, err := openBackend(name, opts)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %v", name, err)
+		}
+		err = f(backend)
+		if closeErr := backend.close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func query(s storage) error {
+func insert(s storage, cfg config) (time.Duration, error) {
 	t, err := timed(func() error {
-		members := makeRange(0, MEMBER_QUERY_SIZE)
-		movies := makeRange(0, MOVIE_QUERY_SIZE)
-		data, err := s.query(members, movies)
-		if err != nil {
+		if err := s.insertRandomMembers(cfg.members); err != nil {
 			return err
 		}
-		expectedLen := MEMBER_QUERY_SIZE * MOVIE_QUERY_SIZE
-		if len(data) != expectedLen {
-			log.Fatalf("%s wrong number of query results: expected %d, got %d", s.name(), expectedLen, len(data))
+		if err := s.insertRandomMovies(cfg.movies); err != nil {
+			return err
 		}
 		return nil
 	})
 
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	println(s.name(), "query time ", t.Milliseconds())
-	return nil
+	println(s.name(), "insert time", t.Milliseconds())
+	return t, nil
 }
 
-func queryRange(s storage) error {
-	t, err := timed(func() error {
-		movies := makeRange(0, MOVIE_QUERY_SIZE)
-		_, err := s.queryRange(0, MEMBER_QUERY_SIZE, movies)
-		return err
-	})
+// The functions below run one iteration of each workload, see workload.run
 
-	if err != nil {
-		return err
-	}
+func queryModels(s storage, cfg config) ([]output, error) {
+	members := makeRange(0, uint32(cfg.memberQuerySize))
+	models := cfg.generator().models(cfg.modelQuerySize, cfg.movies)
+	return s.queryModel(members, models)
+}
 
-	println(s.name(), "range query time:", t.Milliseconds())
-	return nil
+func query(s storage, cfg config) ([]output, error) {
+	members := makeRange(0, uint32(cfg.memberQuerySize))
+	movies := makeRange(0, uint32(cfg.movieQuerySize))
+	return s.query(members, movies)
 }
 
-func queryMemberPropensities(s storage) error {
-	t, err := timed(func() error {
-		data, err := s.memberPropensities(3)
-		_ = data
-		// expectedLen := N_MEMBERS
-		// if len(data) != expectedLen {
-		// 	log.Fatalf("wrong number of propensity results: expected %d, got %d", expectedLen, len(data))
-		// }
-		return err
-	})
+func queryRange(s storage, cfg config) ([]output, error) {
+	movies := makeRange(0, uint32(cfg.movieQuerySize))
+	return s.queryRange(0, uint32(cfg.memberQuerySize), movies)
+}
 
-	if err != nil {
-		return err
-	}
+func queryMemberPropensities(s storage, cfg config) ([]output, error) {
+	return s.memberPropensities(3)
+}
 
-	println(s.name(), "all propensities query time ", t.Milliseconds())
-	return nil
+func streamMemberPropensities(s storage, cfg config) ([]output, error) {
+	return collectPropensities(s, 3, cfg.members)
+}
+
+func queryTopMovies(s storage, cfg config) ([]output, error) {
+	return s.topMovies(0, cfg.topK)
+}
+
+func queryTopMembers(s storage, cfg config) ([]output, error) {
+	return s.topMembers(3, cfg.topK)
+}
+
+// countMemberPropensities streams the same outputs as streamMemberPropensities without keeping them
+func countMemberPropensities(s storage, cfg config) (int, error) {
+	n := 0
+	err := s.streamPropensities(3, func(batch []output) error {
+		n += len(batch)
+		return nil
+	})
+	return n, err
 }
@@ -0,0 +1,192 @@
+package main
+
+// memstorage keeps every vector in memory with no storage engine at all, so it's
+// the speed-of-light baseline for the other backends and the oracle in tests.
+// Vectors are stored back to back in one slice per table, vector i is at [i*dim, (i+1)*dim).
+type memstorage struct {
+	members []float64
+	movies  []float64
+	cfg     config
+}
+
+// newMem doesn't generate anything, the dataset is generated when it's inserted
+// or otherwise on first use as there is nothing to load it from
+func newMem(cfg config) (*memstorage, error) {
+	return &memstorage{cfg: cfg}, nil
+}
+
+func (*memstorage) name() string {
+	return "mem"
+}
+
+// generate generates whichever tables haven't been inserted, so mem can be queried
+// without a load like the backends that persist their data
+func (s *memstorage) generate() {
+	if s.members == nil {
+		s.members = generateFlat(s.cfg.members, s.cfg.dim, s.cfg.generator().member)
+	}
+	if s.movies == nil {
+		s.movies = generateFlat(s.cfg.movies, s.cfg.dim, s.cfg.generator().movie)
+	}
+}
+
+// pregenerate generates the dataset of s if it's mem, so that it isn't generated inside
+// the first timed query of a run without a load or warmup
+func pregenerate(s storage) {
+	switch s := s.(type) {
+	case *memstorage:
+		s.generate()
+	case *annstorage:
+		pregenerate(s.storage)
+	}
+}
+
+func (s *memstorage) get(data []float64, id uint32) vector {
+	dim := s.cfg.dim
+	start := int(id) * dim
+	if start+dim > len(data) {
+		return nil
+	}
+	return vector(data[start : start+dim : start+dim])
+}
+
+func (s *memstorage) getMember(id uint32) (vector, error) {
+	s.generate()
+	return s.get(s.members, id), nil
+}
+
+func (s *memstorage) getMovie(id uint32) (vector, error) {
+	s.generate()
+	return s.get(s.movies, id), nil
+}
+
+func (s *memstorage) query(memberids []uint32, movieids []uint32) ([]output, error) {
+	s.generate()
+	memberids = distinct(memberids)
+	movieids = distinct(movieids)
+	vs := make([]output, 0, len(memberids)*len(movieids))
+	for _, movie := range movieids {
+		w := s.get(s.movies, movie)
+		if w == nil {
+			continue
+		}
+		for _, member := range memberids {
+			if v := s.get(s.members, member); v != nil {
+				vs = append(vs, output{member, movie, v.dot(w)})
+			}
+		}
+	}
+	return vs, nil
+}
+
+func (s *memstorage) queryModel(memberids []uint32, models []MovieModel) ([]output, error) {
+	return scoreModels(memberids, models, s.getMember, s.getMovie)
+}
+
+func (s *memstorage) queryRange(low uint32, high uint32, movieids []uint32) ([]output, error) {
+	s.generate()
+	movieids = distinct(movieids)
+	n := rangeLen(low, high, len(s.members)/s.cfg.dim)
+	vs := make([]output, 0, n*len(movieids))
+	for _, movie := range movieids {
+		w := s.get(s.movies, movie)
+		if w == nil {
+			continue
+		}
+		for member := low; member < low+uint32(n); member++ {
+			vs = append(vs, output{member, movie, s.get(s.members, member).dot(w)})
+		}
+	}
+	return vs, nil
+}
+
+func (s *memstorage) memberPropensities(movie uint32) ([]output, error) {
+	s.generate()
+	w := s.get(s.movies, movie)
+	if w == nil {
+		return nil, nil
+	}
+	n := len(s.members) / s.cfg.dim
+	vs := make([]output, 0, n)
+	for member := 0; member < n; member++ {
+		vs = append(vs, output{uint32(member), movie, s.get(s.members, uint32(member)).dot(w)})
+	}
+	return vs, nil
+}
+
+func (s *memstorage) streamPropensities(movie uint32, f func([]output) error) error {
+	s.generate()
+	w := s.get(s.movies, movie)
+	if w == nil {
+		return nil
+	}
+	n := len(s.members) / s.cfg.dim
+	b := newBatcher(withProgress(s.name()+" member propensities", n, f))
+	for member := 0; member < n; member++ {
+		if err := b.add(output{uint32(member), movie, s.get(s.members, uint32(member)).dot(w)}); err != nil {
+			return err
+		}
+	}
+	return b.flush()
+}
+
+func (s *memstorage) topMembers(movie uint32, k int) ([]output, error) {
+	return topMembersByStream(s, movie, k, s.cfg.members)
+}
+
+func (s *memstorage) topMovies(member uint32, k int) ([]output, error) {
+	s.generate()
+	v := s.get(s.members, member)
+	if v == nil {
+		return nil, nil
+	}
+	top := newTopK(k, s.cfg.movies)
+	n := len(s.movies) / s.cfg.dim
+	for movie := 0; movie < n; movie++ {
+		top.add(output{member, uint32(movie), v.dot(s.get(s.movies, uint32(movie)))})
+	}
+	return top.sorted(), nil
+}
+
+func (s *memstorage) scanMembers(f func(id uint32, v vector) error) error {
+	s.generate()
+	n := len(s.members) / s.cfg.dim
+	for member := 0; member < n; member++ {
+		if err := f(uint32(member), s.get(s.members, uint32(member))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func generateFlat(n int, dim int, vector func(id uint32) vector) []float64 {
+	data := make([]float64, 0, n*dim)
+	for i := 0; i < n; i++ {
+		data = append(data, vector(uint32(i))...)
+	}
+	return data
+}
+
+func (s *memstorage) insertRandomMembers(n int) error {
+	t, _ := timed(func() error {
+		s.members = generateFlat(n, s.cfg.dim, s.cfg.generator().member)
+		return nil
+	})
+	println(s.name(), "members insert time", t.Milliseconds())
+	return nil
+}
+
+func (s *memstorage) insertRandomMovies(n int) error {
+	t, _ := timed(func() error {
+		s.movies = generateFlat(n, s.cfg.dim, s.cfg.generator().movie)
+		return nil
+	})
+	println(s.name(), "movie insert time", t.Milliseconds())
+	return nil
+}
+
+func (s *memstorage) close() error {
+	s.members = nil
+	s.movies = nil
+	return nil
+}
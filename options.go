@@ -0,0 +1,244 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+type workload struct {
+	name string
+	// query runs one iteration of the workload
+	query func(storage, config) ([]output, error)
+	// expectedLen is the number of outputs query should return, nil if it isn't checked
+	expectedLen func(config) int
+	// count runs one iteration without keeping the outputs, benchmarks use it instead
+	// of query if it's set. query must return the same outputs for verify.
+	count func(storage, config) (int, error)
+}
+
+var workloads = []workload{
+	{"query", query, func(cfg config) int { return cfg.memberQuerySize * cfg.movieQuerySize }, nil},
+	{"models", queryModels, func(cfg config) int { return cfg.memberQuerySize * cfg.modelQuerySize }, nil},
+	{"range", queryRange, nil, nil},
+	// times memberPropensities, which holds an output per member in memory, use stream on large datasets
+	{"propensities", queryMemberPropensities, func(cfg config) int { return cfg.members }, nil},
+	{"stream", streamMemberPropensities, func(cfg config) int { return cfg.members }, countMemberPropensities},
+	{"topmovies", queryTopMovies, func(cfg config) int { return minInt(cfg.topK, cfg.movies) }, nil},
+	{"topmembers", queryTopMembers, func(cfg config) int { return minInt(cfg.topK, cfg.members) }, nil},
+}
+
+// run runs one iteration of the workload and returns the number of outputs
+func (w workload) run(s storage, cfg config) (int, error) {
+	var n int
+	var err error
+	if w.count != nil {
+		n, err = w.count(s, cfg)
+	} else {
+		var data []output
+		data, err = w.query(s, cfg)
+		n = len(data)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if w.expectedLen != nil {
+		if expectedLen := w.expectedLen(cfg); n != expectedLen {
+			return 0, fmt.Errorf("wrong number of %s results: expected %d, got %d", w.name, expectedLen, n)
+		}
+	}
+	return n, nil
+}
+
+var backendNames = []string{"pg", "badger", "pebble", "sqlite", "flat", "columnar", "mem"}
+
+type options struct {
+	config
+	backends  []string
+	workloads []workload
+
+	warmup     int
+	iterations int
+
+	// relative tolerance when comparing propensities in verify
+	tolerance float64
+
+	// paths to write the report to, empty to skip
+	jsonReport string
+	csvReport  string
+
+	sqliteJournalMode string
+	sqliteMmapSize    int64
+
+	flatAccess string
+
+	parallelism int
+	badgerScan  string
+
+	pgRank string
+
+	// answer topMembers from the IVF index built by the index command
+	ann       bool
+	ivfLists  int
+	ivfProbes int
+}
+
+func parseOptions(cmd string, args []string) (*options, error) {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	backends := fs.String("backend", "pebble", fmt.Sprintf("comma separated list of backends (%s)", strings.Join(backendNames, ", ")))
+	workloadNames := make([]string, 0, len(workloads))
+	for _, w := range workloads {
+		workloadNames = append(workloadNames, w.name)
+	}
+	distributionName := fs.String("distribution", DISTRIBUTION_UNIFORM.String(), fmt.Sprintf("how the elements of the generated vectors are spread (%s), load and query with the same distribution like the seed", strings.Join(distributionNames, ", ")))
+	encodingName := fs.String("encoding", ENCODING_FLOAT64.String(), fmt.Sprintf("how vectors are stored when loading (%s), the mem and columnar backends always use float64. Verify lossy encodings with a looser -tolerance", strings.Join(encodingNames, ", ")))
+	selected := fs.String("workload", "query,models,range", fmt.Sprintf("comma separated list of workloads (%s)", strings.Join(workloadNames, ", ")))
+
+	opts := &options{config: defaultConfig()}
+	fs.StringVar(&opts.dir, "dir", opts.dir, "directory to store the data of the embedded backends in")
+	fs.IntVar(&opts.members, "members", opts.members, "number of members in the dataset")
+	fs.IntVar(&opts.movies, "movies", opts.movies, "number of movies in the dataset")
+	fs.IntVar(&opts.dim, "dim", opts.dim, "number of elements in each member and movie vector when loading")
+	fs.Int64Var(&opts.seed, "seed", opts.seed, "seed of the generated dataset, load and query with the same seed to compare results")
+	fs.IntVar(&opts.movieQuerySize, "movie-query-size", opts.movieQuerySize, "number of movies per query")
+	fs.IntVar(&opts.modelQuerySize, "model-query-size", opts.modelQuerySize, "number of models per model query")
+	fs.IntVar(&opts.memberQuerySize, "member-query-size", opts.memberQuerySize, "number of members per query")
+	fs.IntVar(&opts.topK, "top-k", opts.topK, "number of results of the top k workloads")
+	fs.IntVar(&opts.warmup, "warmup", 2, "number of unrecorded runs of each workload before measuring")
+	fs.IntVar(&opts.iterations, "iterations", 20, "number of recorded runs of each workload")
+	fs.Float64Var(&opts.tolerance, "tolerance", 1e-9, "relative tolerance when verifying propensities")
+	fs.StringVar(&opts.jsonReport, "json", "", "write a JSON report of the run to this path")
+	fs.StringVar(&opts.csvReport, "csv", "", "write a CSV report of the run to this path")
+	fs.StringVar(&opts.sqliteJournalMode, "sqlite-journal", "wal", fmt.Sprintf("sqlite journal mode (%s)", strings.Join(sqliteJournalModes, ", ")))
+	fs.Int64Var(&opts.sqliteMmapSize, "sqlite-mmap", 0, "number of bytes of the sqlite database to mmap, 0 disables mmap")
+
+	fs.StringVar(&opts.flatAccess, "flat-access", "pread", "how the flat backend reads its files (pread or mmap)")
+	fs.StringVar(&opts.pgRank, "pg-rank", "go", "where pg ranks members for topmembers, go to stream every member or sql to order by the propensity in postgres. sql needs the data to be loaded with -pg-rank sql")
+	fs.BoolVar(&opts.ann, "ann", false, "answer topmembers approximately from the IVF index built by the index command")
+	fs.IntVar(&opts.ivfLists, "ivf-lists", 256, "number of k-means clusters in the IVF index")
+	fs.IntVar(&opts.ivfProbes, "ivf-probes", 8, "number of IVF lists scored by an approximate topmembers")
+	fs.IntVar(&opts.parallelism, "parallelism", 1, "number of goroutines the pebble and badger full scans read the members with")
+	fs.StringVar(&opts.badgerScan, "badger-scan", "iterator", "how badger full scans read the members, iterator to split the keys into a range per goroutine or stream to use badger's Stream framework")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if opts.members <= 0 || opts.movies <= 0 {
+		return nil, fmt.Errorf("members and movies must be positive")
+	}
+	if opts.movieQuerySize <= 0 || opts.modelQuerySize <= 0 || opts.memberQuerySize <= 0 {
+		return nil, fmt.Errorf("query sizes must be positive")
+	}
+	if opts.topK <= 0 {
+		return nil, fmt.Errorf("top-k must be positive")
+	}
+	if opts.iterations <= 0 {
+		return nil, fmt.Errorf("iterations must be positive")
+	}
+	if opts.parallelism <= 0 {
+		return nil, fmt.Errorf("parallelism must be positive")
+	}
+	if opts.ivfLists <= 0 || opts.ivfProbes <= 0 {
+		return nil, fmt.Errorf("ivf-lists and ivf-probes must be positive")
+	}
+	if opts.dim <= 0 || opts.dim > MAX_DIM {
+		return nil, fmt.Errorf("dim must be between 1 and %d", MAX_DIM)
+	}
+	distribution, err := parseDistribution(*distributionName)
+	if err != nil {
+		return nil, err
+	}
+	opts.distribution = distribution
+	encoding, err := parseEncoding(*encodingName)
+	if err != nil {
+		return nil, err
+	}
+	opts.encoding = encoding
+	if opts.memberQuerySize > opts.members || opts.movieQuerySize > opts.movies {
+		return nil, fmt.Errorf("query sizes can't exceed the dataset size")
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	for _, name := range splitList(*backends) {
+		if !contains(backendNames, name) {
+			return nil, fmt.Errorf("unknown backend %q", name)
+		}
+		opts.backends = append(opts.backends, name)
+	}
+
+	for _, name := range splitList(*selected) {
+		w, ok := findWorkload(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown workload %q", name)
+		}
+		opts.workloads = append(opts.workloads, w)
+	}
+
+	return opts, nil
+}
+
+// openBackend opens the backend, wrapped to use its IVF index if opts.ann is set
+func openBackend(name string, opts *options) (storage, error) {
+	s, err := openStorage(name, opts)
+	if err != nil || !opts.ann {
+		return s, err
+	}
+	ann, err := openANN(s, opts.config, opts.ivfProbes)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	return ann, nil
+}
+
+func openStorage(name string, opts *options) (storage, error) {
+	switch name {
+	case "pg":
+		return newPg(opts.config, opts.pgRank)
+	case "badger":
+		return newBadger(opts.config, opts.parallelism, opts.badgerScan)
+	case "pebble":
+		return newPebble(opts.config, opts.parallelism)
+	case "sqlite":
+		return newSqlite(opts.config, opts.sqliteJournalMode, opts.sqliteMmapSize)
+	case "flat":
+		return newFlat(opts.config, opts.flatAccess)
+	case "columnar":
+		return newColumnar(opts.config)
+	case "mem":
+		return newMem(opts.config)
+	default:
+		return nil, fmt.Errorf("unknown backend %q", name)
+	}
+}
+
+func findWorkload(name string) (workload, bool) {
+	for _, w := range workloads {
+		if w.name == name {
+			return w, true
+		}
+	}
+	return workload{}, false
+}
+
+// splitList splits a comma separated flag value, ignoring empty elements
+func splitList(s string) []string {
+	var xs []string
+	for _, x := range strings.Split(s, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			xs = append(xs, x)
+		}
+	}
+	return xs
+}
+
+func contains(xs []string, x string) bool {
+	for _, y := range xs {
+		if x == y {
+			return true
+		}
+	}
+	return false
+}
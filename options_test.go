@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseOptionsRejectsInvalidSizes(t *testing.T) {
+	invalid := []string{
+		"-members 0",
+		"-members -5",
+		"-movies 0 -movie-query-size 0",
+		"-movie-query-size 0",
+		"-model-query-size 0",
+		"-member-query-size -1",
+		"-members 10 -member-query-size 11",
+		"-top-k 0",
+		"-top-k -3",
+	}
+	for _, args := range invalid {
+		if _, err := parseOptions("test", strings.Fields(args)); err == nil {
+			t.Errorf("%s should be rejected", args)
+		}
+	}
+
+	if _, err := parseOptions("test", strings.Fields("-members 10 -movies 10 -member-query-size 10 -movie-query-size 10")); err != nil {
+		t.Error(err)
+	}
+}
@@ -2,7 +2,7 @@ package main
 
 import (
 	"encoding/binary"
-	"log"
+	"path/filepath"
 
 	"github.com/cockroachdb/pebble"
 )
@@ -10,15 +10,18 @@ import (
 type pebblestorage struct {
 	memberdb *pebble.DB
 	moviedb  *pebble.DB
+	cfg      config
+	// number of key ranges full scans are split into, each scanned by its own goroutine
+	parallelism int
 }
 
-func newPebble() (*pebblestorage, error) {
-	memberdb, err := pebble.Open("pebble_members", &pebble.Options{})
+func newPebble(cfg config, parallelism int) (*pebblestorage, error) {
+	memberdb, err := pebble.Open(filepath.Join(cfg.dir, "pebble_members"), &pebble.Options{})
 	if err != nil {
 		return nil, err
 	}
-	moviedb, err := pebble.Open("pebble_movies", &pebble.Options{})
-	return &pebblestorage{memberdb, moviedb}, err
+	moviedb, err := pebble.Open(filepath.Join(cfg.dir, "pebble_movies"), &pebble.Options{})
+	return &pebblestorage{memberdb, moviedb, cfg, parallelism}, err
 }
 
 func (s *pebblestorage) name() string {
@@ -26,106 +29,173 @@ func (s *pebblestorage) name() string {
 }
 
 func (s *pebblestorage) query(memberids []uint32, movieids []uint32) ([]output, error) {
-	capacity := len(memberids) * len(movieids)
-	vs := make([]output, 0, capacity)
-	ch := make(chan output)
+	return scorePerMovie(memberids, movieids, s.getMember, s.getMovie)
+}
 
-	for _, movie := range movieids {
-		go func(movie uint32) {
-			for _, member := range memberids {
-				v := s.getMember(member)
-				w := s.getMovie(movie)
-				propensity := v.dot(w)
-				// vs = append(vs, output{member, movie, propensity})
-				ch <- output{member, movie, propensity}
-			}
-		}(movie)
-	}
+func (s *pebblestorage) queryModel(memberids []uint32, models []MovieModel) ([]output, error) {
+	return scoreModels(memberids, models, s.getMember, s.getMovie)
+}
 
-	for i := 0; i < capacity; i++ {
-		vs = append(vs, <-ch)
+func (s *pebblestorage) memberPropensities(movie uint32) ([]output, error) {
+	return collectPropensities(s, movie, s.cfg.members)
+}
+
+func (s *pebblestorage) streamPropensities(movie uint32, f func([]output) error) error {
+	w, err := s.getMovie(movie)
+	if err != nil || w == nil {
+		return err
 	}
 
-	return vs, nil
+	f = withProgress(s.name()+" member propensities", s.cfg.members, f)
+	return scanPartitioned(s.cfg.members, s.parallelism, f, func(r keyRange, emit func([]output) error) error {
+		lower, upper := r.bounds()
+		iter := s.memberdb.NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: upper})
+		defer iter.Close()
+		b := newBatcher(emit)
+		var v vector
+		var err error
+		for iter.First(); iter.Valid(); iter.Next() {
+			member := binary.BigEndian.Uint32(iter.Key())
+			if v, err = decodeVectorOf(v, iter.Value(), len(w)); err != nil {
+				return err
+			}
+			if err := b.add(output{member, movie, v.dot(w)}); err != nil {
+				return err
+			}
+		}
+		if err := iter.Error(); err != nil {
+			return err
+		}
+		return b.flush()
+	})
 }
 
-func (s *pebblestorage) queryModel(memberids []uint32, models []MovieModel) ([]output, error) {
-	vs := make([]output, 0, len(memberids)*len(models))
-	return vs, nil
+func (s *pebblestorage) topMembers(movie uint32, k int) ([]output, error) {
+	return topMembersByStream(s, movie, k, s.cfg.members)
 }
 
-func (s *pebblestorage) memberPropensities(movie uint32) ([]output, error) {
-	vs := make([]output, 0, N_MEMBERS)
+func (s *pebblestorage) topMovies(member uint32, k int) ([]output, error) {
+	v, err := s.getMember(member)
+	if err != nil || v == nil {
+		return nil, err
+	}
+
+	top := newTopK(k, s.cfg.movies)
+	iter := s.moviedb.NewIter(&pebble.IterOptions{})
+	defer iter.Close()
+	var w vector
+	for iter.First(); iter.Valid(); iter.Next() {
+		movie := binary.BigEndian.Uint32(iter.Key())
+		if w, err = decodeVectorOf(w, iter.Value(), len(v)); err != nil {
+			return nil, err
+		}
+		top.add(output{member, movie, v.dot(w)})
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	return top.sorted(), nil
+}
+
+func (s *pebblestorage) scanMembers(f func(id uint32, v vector) error) error {
 	iter := s.memberdb.NewIter(&pebble.IterOptions{})
-	i := 0
+	defer iter.Close()
+	var v vector
+	var err error
 	for iter.First(); iter.Valid(); iter.Next() {
-		println(s.name(), "member propensity", i)
-		i++
-		if i == 1_000_000 {
-			break
+		if v, err = decodeVector(v, iter.Value()); err != nil {
+			return err
+		}
+		if err := f(binary.BigEndian.Uint32(iter.Key()), v); err != nil {
+			return err
 		}
-		member := binary.BigEndian.Uint32(iter.Key())
-		v := vecFromBytes(iter.Value())
-		w := s.getMovie(movie)
-		propensity := v.dot(w)
-		vs = append(vs, output{member, movie, propensity})
 	}
-	return vs, nil
+	return iter.Error()
 }
 
 func (s *pebblestorage) queryRange(low uint32, high uint32, movieids []uint32) ([]output, error) {
-	vs := make([]output, 0, int(high-low)*len(movieids))
+	movieids = distinct(movieids)
+	vs := make([]output, 0, rangeLen(low, high, s.cfg.members)*len(movieids))
+	if high <= low {
+		return vs, nil
+	}
 	iter := s.memberdb.NewIter(&pebble.IterOptions{LowerBound: uint32ToBeBytes(low), UpperBound: uint32ToBeBytes(high)})
+	defer iter.Close()
+	var v vector
 	for _, movie := range movieids {
+		w, err := s.getMovie(movie)
+		if err != nil {
+			return nil, err
+		}
+		if w == nil {
+			continue
+		}
 		for iter.First(); iter.Valid(); iter.Next() {
 			member := binary.BigEndian.Uint32(iter.Key())
-			v := vecFromBytes(iter.Value())
-			w := s.getMovie(movie)
-			propensity := v.dot(w)
-			vs = append(vs, output{member, movie, propensity})
+			if v, err = decodeVectorOf(v, iter.Value(), len(w)); err != nil {
+				return nil, err
+			}
+			vs = append(vs, output{member, movie, v.dot(w)})
 		}
 	}
-	return vs, nil
+	return vs, iter.Error()
 }
 
-func get(db *pebble.DB, id uint32) vector {
+func get(db *pebble.DB, id uint32) (vector, error) {
 	bytes, closer, err := db.Get(uint32ToBeBytes(id))
+	if err == pebble.ErrNotFound {
+		return nil, nil
+	}
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	if err := closer.Close(); err != nil {
-		log.Fatal(err)
+	// bytes is only valid until closer is closed
+	v, err := decodeVector(nil, bytes)
+	if err != nil {
+		closer.Close()
+		return nil, err
 	}
-	return vecFromBytes(bytes)
+	return v, closer.Close()
 }
 
-func (s *pebblestorage) getMember(id uint32) vector {
+func (s *pebblestorage) getMember(id uint32) (vector, error) {
 	return get(s.memberdb, id)
 }
 
-func (s *pebblestorage) getMovie(id uint32) vector {
+func (s *pebblestorage) getMovie(id uint32) (vector, error) {
 	return get(s.moviedb, id)
 }
 
-func set(db *pebble.DB, id uint32, v vector) error {
-	return db.Set(uint32ToBeBytes(id), v.toBytes(), &pebble.WriteOptions{})
+func set(db *pebble.DB, id uint32, v vector, e encoding) error {
+	return db.Set(uint32ToBeBytes(id), v.toBytes(e), &pebble.WriteOptions{})
+}
+
+// clearKeys deletes every key so a load replaces the previous one rather than leaving behind
+// the ids it doesn't overwrite. Keys are 4 bytes so they all sort before 5 0xff bytes.
+func clearKeys(db *pebble.DB) error {
+	return db.DeleteRange([]byte{}, []byte{0xff, 0xff, 0xff, 0xff, 0xff}, &pebble.WriteOptions{})
 }
 
 func (s *pebblestorage) setMember(id uint32, v vector) error {
-	return set(s.memberdb, id, v)
+	return set(s.memberdb, id, v, s.cfg.encoding)
 }
 
 func (s *pebblestorage) setMovie(id uint32, v vector) error {
 
-	return set(s.moviedb, id, v)
+	return set(s.moviedb, id, v, s.cfg.encoding)
 }
 
 func (s *pebblestorage) insertRandomMembers(n int) error {
 	t, err := timed(func() error {
-		var err error
+		gen := s.cfg.generator()
+		p := newProgress(s.name()+" members insert", n)
+		err := clearKeys(s.memberdb)
+		if err != nil {
+			return err
+		}
 		for i := 0; i < n; i++ {
-			println("pebble insert (counting up)", i)
-			err = s.setMember(uint32(i), randomvec())
+			p.add(1)
+			err = s.setMember(uint32(i), gen.member(uint32(i)))
 			if err != nil {
 				return err
 			}
@@ -143,9 +213,13 @@ func (s *pebblestorage) insertRandomMembers(n int) error {
 
 func (s *pebblestorage) insertRandomMovies(n int) error {
 	t, err := timed(func() error {
-		var err error
+		gen := s.cfg.generator()
+		err := clearKeys(s.moviedb)
+		if err != nil {
+			return err
+		}
 		for i := 0; i < n; i++ {
-			err = s.setMovie(uint32(i), randomvec())
+			err = s.setMovie(uint32(i), gen.movie(uint32(i)))
 			if err != nil {
 				return err
 			}
@@ -160,3 +234,10 @@ func (s *pebblestorage) insertRandomMovies(n int) error {
 	println(s.name(), "movie insert time", t.Milliseconds())
 	return nil
 }
+
+func (s *pebblestorage) close() error {
+	if err := s.memberdb.Close(); err != nil {
+		return err
+	}
+	return s.moviedb.Close()
+}
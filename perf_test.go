@@ -6,36 +6,36 @@ import (
 )
 
 func BenchmarkPg(b *testing.B) {
-	pg, err := newPg()
+	pg, err := newPg(defaultConfig(), "go")
 	for i := 0; i < b.N; i++ {
 		if err != nil {
 			log.Fatal(err)
 		}
-		if err := query(pg); err != nil {
+		if _, err := query(pg, defaultConfig()); err != nil {
 			log.Fatal(err)
 		}
 	}
 }
 
 func BenchmarkBadger(b *testing.B) {
-	badger, err := newBadger()
+	badger, err := newBadger(defaultConfig(), 1, "iterator")
 	for i := 0; i < b.N; i++ {
 		if err != nil {
 			log.Fatal(err)
 		}
-		if err := query(badger); err != nil {
+		if _, err := query(badger, defaultConfig()); err != nil {
 			log.Fatal(err)
 		}
 	}
 }
 
 func BenchmarkPebble(b *testing.B) {
-	pebble, err := newPebble()
+	pebble, err := newPebble(defaultConfig(), 1)
 	for i := 0; i < b.N; i++ {
 		if err != nil {
 			log.Fatal(err)
 		}
-		if err := query(pebble); err != nil {
+		if _, err := query(pebble, defaultConfig()); err != nil {
 			log.Fatal(err)
 		}
 	}
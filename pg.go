@@ -9,10 +9,18 @@ import (
 )
 
 type pgstorage struct {
-	db *pgx.Conn
+	db  *pgx.Conn
+	cfg config
+	// "go" to rank members in topMembers by streaming them all, or "sql" to have postgres
+	// order them by the dot product of the vector_array column, which is only filled in
+	// when loading with "sql"
+	rank string
 }
 
-func newPg() (*pgstorage, error) {
+func newPg(cfg config, rank string) (*pgstorage, error) {
+	if rank != "go" && rank != "sql" {
+		return nil, fmt.Errorf("unknown pg rank %q", rank)
+	}
 	ctx := context.Background()
 	dsn := "host=localhost user=user password=password dbname=postgres sslmode=disable"
 	connConfig, err := pgx.ParseConfig(dsn)
@@ -27,11 +35,19 @@ func newPg() (*pgstorage, error) {
 	if err != nil {
 		return nil, err
 	}
+	// the vector as an array of float8 too so postgres can compute dot products, only
+	// added when it's used so other runs don't change the schema
+	if rank == "sql" {
+		_, err = db.Exec(ctx, "alter table members add column if not exists vector_array float8[]")
+		if err != nil {
+			return nil, err
+		}
+	}
 	_, err = db.Exec(ctx, "create table if not exists movies(id integer primary key, vector bytea)")
 	if err != nil {
 		return nil, err
 	}
-	return &pgstorage{db}, err
+	return &pgstorage{db, cfg, rank}, err
 }
 
 func (*pgstorage) name() string {
@@ -60,7 +76,12 @@ func (s *pgstorage) queryModel(memberids []uint32, models []MovieModel) ([]outpu
 			if err := rows.Scan(&row.id, &row.vector); err != nil {
 				return nil, err
 			}
-			v.addAssign(vecFromBytes(row.vector))
+			w, err := decodeVectorOf(nil, row.vector, len(v))
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			v.addAssign(w)
 		}
 		v.divAssign(float64(len(model.movies)))
 		movieVectors = append(movieVectors, v)
@@ -73,15 +94,22 @@ func (s *pgstorage) queryModel(memberids []uint32, models []MovieModel) ([]outpu
 		return nil, err
 	}
 
+	var member vector
 	for rows.Next() {
 		if err := rows.Scan(&row.id, &row.vector); err != nil {
 			return nil, err
 		}
+		if member, err = decodeVector(member, row.vector); err != nil {
+			return nil, err
+		}
 
 		for _, v := range movieVectors {
+			if err := checkDims(member, len(v)); err != nil {
+				return nil, err
+			}
 			// Don't really have a movie id as it's a model
 			// We could insert each model as a movie maybe
-			vs = append(vs, output{member: row.id, movie: math.MaxUint32, propensity: v.dot(vecFromBytes(row.vector))})
+			vs = append(vs, output{member: row.id, movie: math.MaxUint32, propensity: v.dot(member)})
 		}
 	}
 
@@ -108,14 +136,19 @@ func (s *pgstorage) query(memberids []uint32, movieids []uint32) ([]output, erro
 	}
 	defer rows.Close()
 
+	var member_vector, movie_vector vector
 	for rows.Next() {
 		var x row
 		if err := rows.Scan(&x.member_id, &x.movie_id, &x.member_vector, &x.movie_vector); err != nil {
 			return nil, err
 		}
 
-		member_vector := vecFromBytes(x.member_vector)
-		movie_vector := vecFromBytes(x.movie_vector)
+		if member_vector, err = decodeVector(member_vector, x.member_vector); err != nil {
+			return nil, err
+		}
+		if movie_vector, err = decodeVectorOf(movie_vector, x.movie_vector, len(member_vector)); err != nil {
+			return nil, err
+		}
 		propensity := member_vector.dot(movie_vector)
 		vs = append(vs, output{
 			member:     x.member_id,
@@ -127,59 +160,187 @@ func (s *pgstorage) query(memberids []uint32, movieids []uint32) ([]output, erro
 }
 
 func (s *pgstorage) memberPropensities(movie uint32) ([]output, error) {
-	vs := make([]output, 0, N_MEMBERS)
+	return collectPropensities(s, movie, s.cfg.members)
+}
+
+// streamPropensities relies on pgx reading rows off the connection as they're
+// scanned, so only a batch of outputs is in memory at once
+func (s *pgstorage) streamPropensities(movie uint32, f func([]output) error) error {
 	query := `select members.id as member_id, movies.id as movie_id, members.vector as member_vector, movies.vector as movie_vector
 			  from members cross join movies where movies.id = $1`
 	rows, err := s.db.Query(context.Background(), query, movie)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	// defer rows.Close()
+	defer rows.Close()
 
-	i := 0
+	b := newBatcher(withProgress(s.name()+" member propensities", s.cfg.members, f))
+	var member_vector, movie_vector vector
 	for rows.Next() {
-		println(s.name(), "member propensity", i)
-		i++
+		var x row
+		if err := rows.Scan(&x.member_id, &x.movie_id, &x.member_vector, &x.movie_vector); err != nil {
+			return err
+		}
+		if member_vector, err = decodeVector(member_vector, x.member_vector); err != nil {
+			return err
+		}
+		if movie_vector, err = decodeVectorOf(movie_vector, x.movie_vector, len(member_vector)); err != nil {
+			return err
+		}
+		if err := b.add(output{x.member_id, x.movie_id, member_vector.dot(movie_vector)}); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return b.flush()
+}
+
+// pgGet returns the vector of id in table, or nil if there is no such row
+func (s *pgstorage) pgGet(table string, id uint32) (vector, error) {
+	var bytes []byte
+	err := s.db.QueryRow(context.Background(), fmt.Sprintf("select vector from %s where id = $1", table), id).Scan(&bytes)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeVector(nil, bytes)
+}
 
-		if i == 1_000_000 {
-			break
+func (s *pgstorage) getMember(id uint32) (vector, error) {
+	return s.pgGet("members", id)
+}
+
+func (s *pgstorage) getMovie(id uint32) (vector, error) {
+	return s.pgGet("movies", id)
+}
+
+func (s *pgstorage) scanMembers(f func(id uint32, v vector) error) error {
+	rows, err := s.db.Query(context.Background(), `select id, vector from members order by id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var row struct {
+		id     uint32
+		vector []byte
+	}
+	var v vector
+	for rows.Next() {
+		if err := rows.Scan(&row.id, &row.vector); err != nil {
+			return err
 		}
+		if v, err = decodeVector(v, row.vector); err != nil {
+			return err
+		}
+		if err := f(row.id, v); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
 
-		var x row
-		if err := rows.Scan(&x.member_id, &x.movie_id, &x.member_vector, &x.movie_vector); err != nil {
+func (s *pgstorage) topMovies(member uint32, k int) ([]output, error) {
+	v, err := s.getMember(member)
+	if err != nil || v == nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(context.Background(), `select id, vector from movies`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	top := newTopK(k, s.cfg.movies)
+	var row struct {
+		id     uint32
+		vector []byte
+	}
+	var w vector
+	for rows.Next() {
+		if err := rows.Scan(&row.id, &row.vector); err != nil {
 			return nil, err
 		}
+		if w, err = decodeVectorOf(w, row.vector, len(v)); err != nil {
+			return nil, err
+		}
+		top.add(output{member, row.id, v.dot(w)})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return top.sorted(), nil
+}
 
-		member_vector := vecFromBytes(x.member_vector)
-		movie_vector := vecFromBytes(x.movie_vector)
-		propensity := member_vector.dot(movie_vector)
-		vs = append(vs, output{
-			member:     x.member_id,
-			movie:      x.movie_id,
-			propensity: propensity,
-		})
+func (s *pgstorage) topMembers(movie uint32, k int) ([]output, error) {
+	if s.rank == "sql" {
+		return s.topMembersSQL(movie, k)
 	}
-	return vs, nil
+	return topMembersByStream(s, movie, k, s.cfg.members)
+}
+
+// topMembersSQL has postgres compute every propensity and only return the best k,
+// ties are broken by member id like topK
+func (s *pgstorage) topMembersSQL(movie uint32, k int) ([]output, error) {
+	if k <= 0 {
+		return nil, nil
+	}
+	w, err := s.getMovie(movie)
+	if err != nil || w == nil {
+		return nil, err
+	}
+
+	query := `select id, (select sum(x * y) from unnest(vector_array, $1::float8[]) as t(x, y)) as propensity
+			  from members order by propensity desc nulls last, id limit $2`
+	rows, err := s.db.Query(context.Background(), query, []float64(w), k)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	vs := make([]output, 0, minInt(k, s.cfg.members))
+	for rows.Next() {
+		var id uint32
+		var propensity *float64
+		if err := rows.Scan(&id, &propensity); err != nil {
+			return nil, err
+		}
+		if propensity == nil {
+			return nil, fmt.Errorf("member %d has no vector_array, load pg with -pg-rank sql", id)
+		}
+		vs = append(vs, output{id, movie, *propensity})
+	}
+	return vs, rows.Err()
 }
 
 func (s *pgstorage) queryRange(low uint32, high uint32, movieids []uint32) ([]output, error) {
-	vs := make([]output, 0, int(high-low)*len(movieids))
+	vs := make([]output, 0, rangeLen(low, high, s.cfg.members)*len(movieids))
 	query := `select members.id as member_id, movies.id as movie_id, members.vector as member_vector, movies.vector as movie_vector
-			  from members cross join movies where members.id between $1 and $2 and movies.id = any($3)`
+			  from members cross join movies where members.id >= $1 and members.id < $2 and movies.id = any($3)`
 	rows, err := s.db.Query(context.Background(), query, low, high, movieids)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	var member_vector, movie_vector vector
 	for rows.Next() {
 		var x row
 		if err := rows.Scan(&x.member_id, &x.movie_id, &x.member_vector, &x.movie_vector); err != nil {
 			return nil, err
 		}
 
-		member_vector := vecFromBytes(x.member_vector)
-		movie_vector := vecFromBytes(x.movie_vector)
+		if member_vector, err = decodeVector(member_vector, x.member_vector); err != nil {
+			return nil, err
+		}
+		if movie_vector, err = decodeVectorOf(movie_vector, x.movie_vector, len(member_vector)); err != nil {
+			return nil, err
+		}
 		propensity := member_vector.dot(movie_vector)
 		vs = append(vs, output{
 			member:     x.member_id,
@@ -193,18 +354,28 @@ func (s *pgstorage) queryRange(low uint32, high uint32, movieids []uint32) ([]ou
 
 func (s *pgstorage) insertRandomMembers(n int) error {
 	ctx := context.Background()
-	_, err := s.db.CopyFrom(ctx, pgx.Identifier{"members"}, []string{"id", "vector"}, &randomSource{n})
+	columns := []string{"id", "vector"}
+	if s.rank == "sql" {
+		columns = append(columns, "vector_array")
+	}
+	_, err := s.db.CopyFrom(ctx, pgx.Identifier{"members"}, columns, &randomSource{n, s.cfg.generator().member, s.cfg.encoding, s.rank == "sql", newProgress(s.name()+" members insert", n)})
 	return err
 }
 
 func (s *pgstorage) insertRandomMovies(n int) error {
 	ctx := context.Background()
-	_, err := s.db.CopyFrom(ctx, pgx.Identifier{"movies"}, []string{"id", "vector"}, &randomSource{n})
+	_, err := s.db.CopyFrom(ctx, pgx.Identifier{"movies"}, []string{"id", "vector"}, &randomSource{n, s.cfg.generator().movie, s.cfg.encoding, false, newProgress(s.name()+" movies insert", n)})
 	return err
 }
 
 type randomSource struct {
-	n int
+	n        int
+	vector   func(id uint32) vector
+	encoding encoding
+	// also copy the vector as a float8[] of the decoded vector, so it has the same
+	// precision as the encoded one
+	array    bool
+	progress *progress
 }
 
 func (s *randomSource) Next() bool {
@@ -215,7 +386,19 @@ func (s *randomSource) Next() bool {
 func (s *randomSource) Err() error { return nil }
 
 func (s *randomSource) Values() ([]interface{}, error) {
-	v := randomvec()
-	println("pg insert (counting down)", s.n)
-	return []interface{}{s.n, v.toBytes()}, nil
+	v := s.vector(uint32(s.n))
+	s.progress.add(1)
+	encoded := v.toBytes(s.encoding)
+	if s.array {
+		decoded, err := decodeVector(nil, encoded)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{s.n, encoded, []float64(decoded)}, nil
+	}
+	return []interface{}{s.n, encoded}, nil
+}
+
+func (s *pgstorage) close() error {
+	return s.db.Close(context.Background())
 }
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Maximum number of members whose propensities are compared per encoding
+const PRECISION_SAMPLE_MEMBERS = 10_000
+
+// precision is the storage size of an encoding and the error it introduces into
+// propensities compared to float64
+type precision struct {
+	encoding       encoding
+	bytesPerVector int
+	// size of the encoded members and movies alone, the backends' files are larger as
+	// they add keys, indexes and their own overhead
+	payloadBytes int64
+	meanAbsError float64
+	maxAbsError  float64
+	maxRelError  float64
+}
+
+// measurePrecision round trips a sample of the generated members and the first
+// movieQuerySize movies through the encoding and compares their propensities to the exact ones
+func measurePrecision(cfg config, e encoding) (precision, error) {
+	p := precision{
+		encoding:       e,
+		bytesPerVector: encodedLen(e, cfg.dim),
+		payloadBytes:   int64(cfg.members+cfg.movies) * int64(encodedLen(e, cfg.dim)),
+	}
+
+	gen := cfg.generator()
+	var buf []byte
+	roundTrip := func(v vector) (vector, error) {
+		buf = encodeVector(buf[:0], v, e)
+		return decodeVector(nil, buf)
+	}
+
+	movies := make([]vector, cfg.movieQuerySize)
+	decodedMovies := make([]vector, cfg.movieQuerySize)
+	for i := range movies {
+		movies[i] = gen.movie(uint32(i))
+		var err error
+		if decodedMovies[i], err = roundTrip(movies[i]); err != nil {
+			return p, err
+		}
+	}
+
+	n := cfg.members
+	if n > PRECISION_SAMPLE_MEMBERS {
+		n = PRECISION_SAMPLE_MEMBERS
+	}
+	var sum float64
+	count := 0
+	for member := 0; member < n; member++ {
+		v := gen.member(uint32(member))
+		decoded, err := roundTrip(v)
+		if err != nil {
+			return p, err
+		}
+		for i, w := range movies {
+			exact := v.dot(w)
+			err := math.Abs(decoded.dot(decodedMovies[i]) - exact)
+			sum += err
+			count++
+			p.maxAbsError = math.Max(p.maxAbsError, err)
+			if exact != 0 {
+				p.maxRelError = math.Max(p.maxRelError, err/math.Abs(exact))
+			}
+		}
+	}
+	if count > 0 {
+		p.meanAbsError = sum / float64(count)
+	}
+	return p, nil
+}
+
+func runPrecision(args []string) error {
+	opts, err := parseOptions("precision", args)
+	if err != nil {
+		return err
+	}
+
+	sample := opts.members
+	if sample > PRECISION_SAMPLE_MEMBERS {
+		sample = PRECISION_SAMPLE_MEMBERS
+	}
+	fmt.Printf("%d members and %d movies of dimension %d from the %s distribution, errors over %d members x %d movies\n",
+		opts.members, opts.movies, opts.dim, opts.distribution, sample, opts.movieQuerySize)
+	fmt.Println("payload is the size of the encoded vectors alone, the backends' size on disk is measured below")
+	fmt.Printf("%-8s %12s %12s %10s %14s %14s %14s\n",
+		"encoding", "bytes/vector", "payload", "payload %", "mean abs error", "max abs error", "max rel error")
+	var baseline int64
+	for i := range encodingNames {
+		p, err := measurePrecision(opts.config, encoding(i))
+		if err != nil {
+			return err
+		}
+		if p.encoding == ENCODING_FLOAT64 {
+			baseline = p.payloadBytes
+		}
+		fmt.Printf("%-8s %12d %12s %9.1f%% %14.3g %14.3g %14.3g\n",
+			p.encoding, p.bytesPerVector, fmtBytes(p.payloadBytes), 100*float64(p.payloadBytes)/float64(baseline),
+			p.meanAbsError, p.maxAbsError, p.maxRelError)
+	}
+
+	sampleCfg := opts.config
+	sampleCfg.members = sample
+	sampleCfg.movies = minInt(opts.movies, PRECISION_SAMPLE_MEMBERS)
+	backends := make([]string, 0, len(opts.backends))
+	for _, name := range opts.backends {
+		if storesEncoding(name) {
+			backends = append(backends, name)
+		}
+	}
+	if len(backends) == 0 {
+		fmt.Println("\nsize on disk isn't measured, none of the -backend backends store the encoding (badger, pebble, sqlite, flat)")
+		return nil
+	}
+	fmt.Printf("\nsize on disk of %d members and %d movies loaded into each backend, projected to the full dataset\n",
+		sampleCfg.members, sampleCfg.movies)
+	fmt.Printf("%-8s %-8s %12s %12s\n", "backend", "encoding", "bytes/vector", "projected")
+	for _, name := range backends {
+		for i := range encodingNames {
+			sampleCfg.encoding = encoding(i)
+			perVector, err := measureDiskSize(name, opts, sampleCfg)
+			if err != nil {
+				return fmt.Errorf("failed to measure the size of %s: %v", name, err)
+			}
+			fmt.Printf("%-8s %-8s %12.1f %12s\n", name, sampleCfg.encoding, perVector,
+				fmtBytes(int64(perVector*float64(opts.members+opts.movies))))
+		}
+	}
+	return nil
+}
+
+// storesEncoding is whether the size of the backend's files depends on the encoding.
+// columnar always stores float64, mem doesn't store anything and pg's database is shared
+// so a sample can't be loaded into it without replacing the dataset.
+func storesEncoding(name string) bool {
+	switch name {
+	case "badger", "pebble", "sqlite", "flat":
+		return true
+	}
+	return false
+}
+
+// measureDiskSize returns the bytes per vector the backend uses on disk once the members
+// and movies of cfg are loaded, less the size of an empty store so the fixed overhead of
+// a small sample, such as preallocated logs, isn't attributed to the vectors
+func measureDiskSize(name string, opts *options, cfg config) (float64, error) {
+	empty := cfg
+	empty.members, empty.movies = 0, 0
+	base, err := loadedDiskUsage(name, opts, empty)
+	if err != nil {
+		return 0, err
+	}
+	size, err := loadedDiskUsage(name, opts, cfg)
+	if err != nil {
+		return 0, err
+	}
+	return float64(size-base) / float64(cfg.members+cfg.movies), nil
+}
+
+// loadedDiskUsage loads cfg into the backend in a temporary directory under cfg.dir, so it is
+// on the same filesystem as the dataset, and returns its size on disk
+func loadedDiskUsage(name string, opts *options, cfg config) (int64, error) {
+	dir, err := os.MkdirTemp(cfg.dir, "storage-perf-precision")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	sampleOpts := *opts
+	sampleOpts.config = cfg
+	sampleOpts.dir = dir
+	s, err := openStorage(name, &sampleOpts)
+	if err != nil {
+		return 0, err
+	}
+	_, err = insert(s, cfg)
+	// closing flushes anything still buffered in memory to disk
+	if closeErr := s.close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return diskUsage(dir)
+}
+
+// diskUsage is the size of the files under dir. Each file counts the smaller of its
+// apparent size and the space allocated to it, as badger's files are sparse and pebble
+// allocates space for its logs past their end.
+func diskUsage(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		n := info.Size()
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Blocks*512 < n {
+			n = stat.Blocks * 512
+		}
+		size += n
+		return nil
+	})
+	return size, err
+}
+
+func fmtBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for x := n / unit; x >= unit; x /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
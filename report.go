@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// report is the machine readable record of a single run of storage-perf
+type report struct {
+	Command     string        `json:"command"`
+	Timestamp   time.Time     `json:"timestamp"`
+	Dataset     datasetParams `json:"dataset"`
+	Settings    settings      `json:"settings"`
+	Warmup      int           `json:"warmup"`
+	Iterations  int           `json:"iterations"`
+	Environment environment   `json:"environment"`
+	Results     []result      `json:"results"`
+	// The error the run stopped at, the results are only of the backends and scenarios before it
+	Error string `json:"error,omitempty"`
+}
+
+type datasetParams struct {
+	Members         int    `json:"members"`
+	Movies          int    `json:"movies"`
+	Dim             int    `json:"dim"`
+	Seed            int64  `json:"seed"`
+	Distribution    string `json:"distribution"`
+	Encoding        string `json:"encoding"`
+	MovieQuerySize  int    `json:"movie_query_size"`
+	ModelQuerySize  int    `json:"model_query_size"`
+	MemberQuerySize int    `json:"member_query_size"`
+	TopK            int    `json:"top_k"`
+}
+
+// settings are the backend flags that change how the same dataset is read
+type settings struct {
+	Parallelism       int    `json:"parallelism"`
+	BadgerScan        string `json:"badger_scan"`
+	SqliteJournalMode string `json:"sqlite_journal_mode"`
+	SqliteMmapSize    int64  `json:"sqlite_mmap_size"`
+	FlatAccess        string `json:"flat_access"`
+	PgRank            string `json:"pg_rank"`
+	ANN               bool   `json:"ann"`
+	IVFProbes         int    `json:"ivf_probes"`
+}
+
+type environment struct {
+	Hostname  string `json:"hostname"`
+	GoVersion string `json:"go_version"`
+	GOOS      string `json:"goos"`
+	GOARCH    string `json:"goarch"`
+	NumCPU    int    `json:"num_cpu"`
+}
+
+type result struct {
+	Backend  string `json:"backend"`
+	Scenario string `json:"scenario"`
+	// Number of outputs returned by the last iteration
+	Results int           `json:"results"`
+	Latency latencyReport `json:"latency_ns"`
+	// Median latency relative to the mem backend in the same run, 0 if it wasn't run
+	Overhead float64 `json:"overhead_vs_mem,omitempty"`
+	// Every recorded latency in nanoseconds, in the order they were recorded
+	Samples []int64 `json:"samples_ns"`
+}
+
+type latencyReport struct {
+	Count  int   `json:"count"`
+	Min    int64 `json:"min"`
+	Max    int64 `json:"max"`
+	Mean   int64 `json:"mean"`
+	Stddev int64 `json:"stddev"`
+	P50    int64 `json:"p50"`
+	P90    int64 `json:"p90"`
+	P99    int64 `json:"p99"`
+	P999   int64 `json:"p999"`
+}
+
+func newReport(command string, opts *options) *report {
+	hostname, _ := os.Hostname()
+	return &report{
+		Command:   command,
+		Timestamp: time.Now().UTC(),
+		Dataset: datasetParams{
+			Members:         opts.members,
+			Movies:          opts.movies,
+			Dim:             opts.dim,
+			Seed:            opts.seed,
+			Distribution:    opts.distribution.String(),
+			Encoding:        opts.encoding.String(),
+			MovieQuerySize:  opts.movieQuerySize,
+			ModelQuerySize:  opts.modelQuerySize,
+			MemberQuerySize: opts.memberQuerySize,
+			TopK:            opts.topK,
+		},
+		Settings: settings{
+			Parallelism:       opts.parallelism,
+			BadgerScan:        opts.badgerScan,
+			SqliteJournalMode: opts.sqliteJournalMode,
+			SqliteMmapSize:    opts.sqliteMmapSize,
+			FlatAccess:        opts.flatAccess,
+			PgRank:            opts.pgRank,
+			ANN:               opts.ann,
+			IVFProbes:         opts.ivfProbes,
+		},
+		Warmup:     opts.warmup,
+		Iterations: opts.iterations,
+		Environment: environment{
+			Hostname:  hostname,
+			GoVersion: runtime.Version(),
+			GOOS:      runtime.GOOS,
+			GOARCH:    runtime.GOARCH,
+			NumCPU:    runtime.NumCPU(),
+		},
+		Results: []result{},
+	}
+}
+
+func (r *report) add(backend string, scenario string, n int, h *histogram) {
+	s := h.summary()
+	samples := make([]int64, len(h.samples))
+	for i, d := range h.samples {
+		samples[i] = int64(d)
+	}
+	r.Results = append(r.Results, result{
+		Backend:  backend,
+		Scenario: scenario,
+		Results:  n,
+		Latency: latencyReport{
+			Count:  s.count,
+			Min:    int64(s.min),
+			Max:    int64(s.max),
+			Mean:   int64(s.mean),
+			Stddev: int64(s.stddev),
+			P50:    int64(s.p50),
+			P90:    int64(s.p90),
+			P99:    int64(s.p99),
+			P999:   int64(s.p999),
+		},
+		Samples: samples,
+	})
+}
+
+// The backend that every other backend is compared to, see memstorage
+const BASELINE_BACKEND = "mem"
+
+// finish compares each result to the baseline backend and writes the report. If the
+// run failed with runErr the results gathered so far are still written and runErr is returned.
+func (r *report) finish(opts *options, runErr error) error {
+	if runErr != nil {
+		r.Error = runErr.Error()
+	}
+	r.computeOverheads()
+	r.printOverheads()
+	if err := r.write(opts); runErr == nil {
+		return err
+	}
+	return runErr
+}
+
+func (r *report) computeOverheads() {
+	baseline := make(map[string]int64)
+	for _, x := range r.Results {
+		if x.Backend == BASELINE_BACKEND {
+			baseline[x.Scenario] = x.Latency.P50
+		}
+	}
+	for i, x := range r.Results {
+		if p50, ok := baseline[x.Scenario]; ok && p50 > 0 {
+			r.Results[i].Overhead = float64(x.Latency.P50) / float64(p50)
+		}
+	}
+}
+
+func (r *report) printOverheads() {
+	printed := false
+	for _, x := range r.Results {
+		if x.Overhead == 0 || x.Backend == BASELINE_BACKEND {
+			continue
+		}
+		if !printed {
+			fmt.Printf("\nmedian latency relative to %s:\n", BASELINE_BACKEND)
+			printed = true
+		}
+		fmt.Printf("%-8s %-14s %8.1fx\n", x.Backend, x.Scenario, x.Overhead)
+	}
+}
+
+func (r *report) write(opts *options) error {
+	if opts.jsonReport != "" {
+		if err := r.writeJSON(opts.jsonReport); err != nil {
+			return err
+		}
+	}
+	if opts.csvReport != "" {
+		if err := r.writeCSV(opts.csvReport); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *report) writeJSON(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+var csvHeader = []string{
+	"timestamp", "command", "backend", "scenario", "results",
+	"members", "movies", "dim", "seed", "encoding", "movie_query_size", "model_query_size", "member_query_size", "top_k",
+	"warmup", "iterations",
+	"min_ms", "mean_ms", "stddev_ms", "p50_ms", "p90_ms", "p99_ms", "p999_ms", "max_ms", "overhead_vs_mem",
+	"hostname", "go_version", "goos", "goarch", "num_cpu",
+	// columns added later are appended so archived reports stay aligned
+	"distribution",
+	"parallelism", "badger_scan", "sqlite_journal_mode", "sqlite_mmap_size", "flat_access", "pg_rank", "ann", "ivf_probes",
+}
+
+// writeCSV writes one row per backend and scenario, the raw samples are only in the JSON report
+func (r *report) writeCSV(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write(csvHeader)
+
+	itoa := strconv.Itoa
+	ms := func(ns int64) string {
+		return strconv.FormatFloat(float64(ns)/float64(time.Millisecond), 'f', 3, 64)
+	}
+	for _, x := range r.Results {
+		w.Write([]string{
+			r.Timestamp.Format(time.RFC3339), r.Command, x.Backend, x.Scenario, itoa(x.Results),
+			itoa(r.Dataset.Members), itoa(r.Dataset.Movies), itoa(r.Dataset.Dim), strconv.FormatInt(r.Dataset.Seed, 10), r.Dataset.Encoding,
+			itoa(r.Dataset.MovieQuerySize), itoa(r.Dataset.ModelQuerySize), itoa(r.Dataset.MemberQuerySize), itoa(r.Dataset.TopK),
+			itoa(r.Warmup), itoa(r.Iterations),
+			ms(x.Latency.Min), ms(x.Latency.Mean), ms(x.Latency.Stddev), ms(x.Latency.P50),
+			ms(x.Latency.P90), ms(x.Latency.P99), ms(x.Latency.P999), ms(x.Latency.Max),
+			strconv.FormatFloat(x.Overhead, 'f', 3, 64),
+			r.Environment.Hostname, r.Environment.GoVersion, r.Environment.GOOS, r.Environment.GOARCH,
+			itoa(r.Environment.NumCPU),
+			r.Dataset.Distribution,
+			itoa(r.Settings.Parallelism), r.Settings.BadgerScan, r.Settings.SqliteJournalMode,
+			strconv.FormatInt(r.Settings.SqliteMmapSize, 10), r.Settings.FlatAccess, r.Settings.PgRank,
+			strconv.FormatBool(r.Settings.ANN), itoa(r.Settings.IVFProbes),
+		})
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
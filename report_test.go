@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestReport() *report {
+	opts := &options{config: conformanceConfig, warmup: 1, iterations: 2, parallelism: 4, flatAccess: "mmap", sqliteMmapSize: 1 << 30}
+	r := newReport("query", opts)
+	for _, backend := range []string{"mem", "flat"} {
+		for _, scenario := range []string{"query", "range"} {
+			h := newHistogram(2)
+			h.record(time.Millisecond)
+			h.record(3 * time.Millisecond)
+			r.add(backend, scenario, 50, h)
+		}
+	}
+	return r
+}
+
+func TestReportJSONRoundTrip(t *testing.T) {
+	r := newTestReport()
+	r.computeOverheads()
+	path := filepath.Join(t.TempDir(), "report.json")
+	if err := r.writeJSON(path); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readReport(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, r) {
+		t.Errorf("read %+v, expected %+v", read, r)
+	}
+}
+
+func TestReportCSV(t *testing.T) {
+	r := newTestReport()
+	path := filepath.Join(t.TempDir(), "report.csv")
+	if err := r.writeCSV(path); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cr := csv.NewReader(f)
+	cr.FieldsPerRecord = -1
+	rows, err := cr.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(r.Results)+1 {
+		t.Fatalf("got %d rows, expected a header and %d results", len(rows), len(r.Results))
+	}
+	if !reflect.DeepEqual(rows[0], csvHeader) {
+		t.Errorf("got the header %v, expected %v", rows[0], csvHeader)
+	}
+	for i, row := range rows[1:] {
+		if len(row) != len(csvHeader) {
+			t.Errorf("row %d has %d columns, the header has %d", i, len(row), len(csvHeader))
+		}
+	}
+}
+
+// A run that fails part way still archives the results it has
+func TestReportFinishWritesPartialResults(t *testing.T) {
+	r := newTestReport()
+	opts := &options{jsonReport: filepath.Join(t.TempDir(), "report.json")}
+	runErr := errors.New("pebble failed")
+	if err := r.finish(opts, runErr); err != runErr {
+		t.Errorf("expected the run's error, got %v", err)
+	}
+	read, err := readReport(opts.jsonReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read.Results) != len(r.Results) || read.Error != runErr.Error() {
+		t.Errorf("read %d results and the error %q", len(read.Results), read.Error)
+	}
+}
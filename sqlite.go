@@ -1,43 +1,352 @@
 package main
 
-// import (
-// 	"database/sql"
-
-// 	_ "github.com/mattn/go-sqlite3"
-// )
-
-// type sqlitestorage struct {
-// 	db *sql.DB
-// }
-
-// func newSqlite() (*sqlitestorage, error) {
-// 	db, err := sql.Open("sqlite3", "./data.sqlite")
-// 	db.Exec("create table if not exists members(id integer, vector blob)")
-// 	db.Exec("create table if not exists movies(id integer, vector blob")
-// 	return &sqlitestorage{db}, err
-// }
-
-// func (*sqlitestorage) name() string {
-// 	return "sqlite"
-// }
-
-// func (*sqlitestorage) query(memberids []uint32, movieids []uint32) ([]output, error) {
-// 	vs := make([]output, 0, len(memberids)*len(movieids))
-// 	return vs, nil
-
-// }
-
-// func (*sqlitestorage) queryRange(low uint32, high uint32, movieids []uint32) ([]output, error) {
-// 	vs := make([]output, 0, int(high-low)*len(movieids))
-// 	return vs, nil
-// }
-
-// func (s *sqlitestorage) setMember(id uint32, v vector) error {
-// 	_, err := s.db.Exec("insert into members (id, vector) values ($1, $2)", id, v.toBytes())
-// 	return err
-// }
-
-// func (s *sqlitestorage) setMovie(id uint32, v vector) error {
-// 	_, err := s.db.Exec("insert into movies (id, vector) values ($1, $2)", id, v.toBytes())
-// 	return err
-// }
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Number of rows inserted per transaction
+const SQLITE_BATCH_SIZE = 100_000
+
+type sqlitestorage struct {
+	db            *sql.DB
+	getMemberStmt *sql.Stmt
+	getMovieStmt  *sql.Stmt
+	cfg           config
+}
+
+// The journal modes sqlite supports, it ignores any other mode
+var sqliteJournalModes = []string{"wal", "delete", "truncate", "persist", "memory", "off"}
+
+// journalMode is either "wal" or one of the rollback journal modes ("delete", "truncate", "persist", "memory", "off").
+// mmapSize is the number of bytes of the database file to memory map, 0 disables mmap.
+func newSqlite(cfg config, journalMode string, mmapSize int64) (*sqlitestorage, error) {
+	valid := false
+	for _, mode := range sqliteJournalModes {
+		valid = valid || mode == journalMode
+	}
+	if !valid {
+		return nil, fmt.Errorf("unknown sqlite journal mode %q", journalMode)
+	}
+
+	db, err := sql.Open("sqlite3", filepath.Join(cfg.dir, "data.sqlite"))
+	if err != nil {
+		return nil, err
+	}
+	// pragmas such as mmap_size only apply to the connection they're executed on
+	db.SetMaxOpenConns(1)
+
+	// the pragma returns the journal mode in use, which isn't the one asked for if it can't be changed
+	var mode string
+	if err := db.QueryRow(fmt.Sprintf("pragma journal_mode = %s", journalMode)).Scan(&mode); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to set the journal mode: %v", err)
+	}
+	if !strings.EqualFold(mode, journalMode) {
+		db.Close()
+		return nil, fmt.Errorf("sqlite is using the journal mode %s rather than %s", mode, journalMode)
+	}
+
+	statements := []string{
+		fmt.Sprintf("pragma mmap_size = %d", mmapSize),
+		"create table if not exists members(id integer primary key, vector blob not null)",
+		"create table if not exists movies(id integer primary key, vector blob not null)",
+	}
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to execute `%s`: %v", stmt, err)
+		}
+	}
+
+	getMemberStmt, err := db.Prepare("select vector from members where id = ?")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	getMovieStmt, err := db.Prepare("select vector from movies where id = ?")
+	if err != nil {
+		getMemberStmt.Close()
+		db.Close()
+		return nil, err
+	}
+	return &sqlitestorage{db, getMemberStmt, getMovieStmt, cfg}, nil
+}
+
+func (*sqlitestorage) name() string {
+	return "sqlite"
+}
+
+func sqliteGet(stmt *sql.Stmt, id uint32) (vector, error) {
+	var bytes []byte
+	err := stmt.QueryRow(id).Scan(&bytes)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get vector %d: %v", id, err)
+	}
+	return decodeVector(nil, bytes)
+}
+
+func (s *sqlitestorage) getMember(id uint32) (vector, error) {
+	return sqliteGet(s.getMemberStmt, id)
+}
+
+func (s *sqlitestorage) getMovie(id uint32) (vector, error) {
+	return sqliteGet(s.getMovieStmt, id)
+}
+
+// getMovies returns the distinct movies that exist and their vectors
+func (s *sqlitestorage) getMovies(movieids []uint32) ([]uint32, []vector, error) {
+	movieids = distinct(movieids)
+	found := make([]uint32, 0, len(movieids))
+	movieVectors := make([]vector, 0, len(movieids))
+	for _, movie := range movieids {
+		w, err := s.getMovie(movie)
+		if err != nil {
+			return nil, nil, err
+		}
+		if w != nil {
+			found = append(found, movie)
+			movieVectors = append(movieVectors, w)
+		}
+	}
+	return found, movieVectors, nil
+}
+
+// sqlite runs in process so point lookups with a prepared statement are cheap,
+// and it avoids building `in (...)` lists that can exceed the bound variable limit
+func (s *sqlitestorage) query(memberids []uint32, movieids []uint32) ([]output, error) {
+	memberids = distinct(memberids)
+	movieids, movieVectors, err := s.getMovies(movieids)
+	if err != nil {
+		return nil, err
+	}
+
+	vs := make([]output, 0, len(memberids)*len(movieids))
+	for _, member := range memberids {
+		v, err := s.getMember(member)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			continue
+		}
+		for i, w := range movieVectors {
+			if err := checkDims(v, len(w)); err != nil {
+				return nil, err
+			}
+			vs = append(vs, output{member, movieids[i], v.dot(w)})
+		}
+	}
+	return vs, nil
+}
+
+func (s *sqlitestorage) queryModel(memberids []uint32, models []MovieModel) ([]output, error) {
+	return scoreModels(memberids, models, s.getMember, s.getMovie)
+}
+
+// Scans members in [low, high), the same bounds as pebble's IterOptions
+func (s *sqlitestorage) queryRange(low uint32, high uint32, movieids []uint32) ([]output, error) {
+	movieids, movieVectors, err := s.getMovies(movieids)
+	if err != nil {
+		return nil, err
+	}
+	vs := make([]output, 0, rangeLen(low, high, s.cfg.members)*len(movieids))
+
+	rows, err := s.db.Query("select id, vector from members where id >= ? and id < ?", low, high)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var row struct {
+		id     uint32
+		vector []byte
+	}
+	var v vector
+	for rows.Next() {
+		if err := rows.Scan(&row.id, &row.vector); err != nil {
+			return nil, err
+		}
+		if v, err = decodeVector(v, row.vector); err != nil {
+			return nil, err
+		}
+		for i, w := range movieVectors {
+			if err := checkDims(v, len(w)); err != nil {
+				return nil, err
+			}
+			vs = append(vs, output{row.id, movieids[i], v.dot(w)})
+		}
+	}
+	return vs, rows.Err()
+}
+
+func (s *sqlitestorage) memberPropensities(movie uint32) ([]output, error) {
+	return collectPropensities(s, movie, s.cfg.members)
+}
+
+func (s *sqlitestorage) streamPropensities(movie uint32, f func([]output) error) error {
+	w, err := s.getMovie(movie)
+	if err != nil || w == nil {
+		return err
+	}
+
+	rows, err := s.db.Query("select id, vector from members")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	b := newBatcher(withProgress(s.name()+" member propensities", s.cfg.members, f))
+	var row struct {
+		id     uint32
+		vector []byte
+	}
+	var v vector
+	for rows.Next() {
+		if err := rows.Scan(&row.id, &row.vector); err != nil {
+			return err
+		}
+		if v, err = decodeVectorOf(v, row.vector, len(w)); err != nil {
+			return err
+		}
+		if err := b.add(output{row.id, movie, v.dot(w)}); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return b.flush()
+}
+
+func (s *sqlitestorage) topMembers(movie uint32, k int) ([]output, error) {
+	return topMembersByStream(s, movie, k, s.cfg.members)
+}
+
+func (s *sqlitestorage) topMovies(member uint32, k int) ([]output, error) {
+	v, err := s.getMember(member)
+	if err != nil || v == nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query("select id, vector from movies")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	top := newTopK(k, s.cfg.movies)
+	var row struct {
+		id     uint32
+		vector []byte
+	}
+	var w vector
+	for rows.Next() {
+		if err := rows.Scan(&row.id, &row.vector); err != nil {
+			return nil, err
+		}
+		if w, err = decodeVectorOf(w, row.vector, len(v)); err != nil {
+			return nil, err
+		}
+		top.add(output{member, row.id, v.dot(w)})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return top.sorted(), nil
+}
+
+func (s *sqlitestorage) scanMembers(f func(id uint32, v vector) error) error {
+	rows, err := s.db.Query("select id, vector from members order by id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var row struct {
+		id     uint32
+		vector []byte
+	}
+	var v vector
+	for rows.Next() {
+		if err := rows.Scan(&row.id, &row.vector); err != nil {
+			return err
+		}
+		if v, err = decodeVector(v, row.vector); err != nil {
+			return err
+		}
+		if err := f(row.id, v); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Replaces the rows of table with ids [0, n), committing every SQLITE_BATCH_SIZE rows
+func (s *sqlitestorage) insertRandom(table string, n int, vector func(id uint32) vector) error {
+	if _, err := s.db.Exec(fmt.Sprintf("delete from %s", table)); err != nil {
+		return err
+	}
+	p := newProgress(s.name()+" "+table+" insert", n)
+	i := 0
+	for i < n {
+		start := i
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		stmt, err := tx.Prepare(fmt.Sprintf("insert into %s (id, vector) values (?, ?)", table))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		for end := i + SQLITE_BATCH_SIZE; i < n && i < end; i++ {
+			if _, err := stmt.Exec(i, vector(uint32(i)).toBytes(s.cfg.encoding)); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		p.add(i - start)
+	}
+	return nil
+}
+
+func (s *sqlitestorage) insertRandomMembers(n int) error {
+	t, err := timed(func() error {
+		return s.insertRandom("members", n, s.cfg.generator().member)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	println(s.name(), "members insert time", t.Milliseconds())
+	return nil
+}
+
+func (s *sqlitestorage) insertRandomMovies(n int) error {
+	t, err := timed(func() error {
+		return s.insertRandom("movies", n, s.cfg.generator().movie)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	println(s.name(), "movie insert time", t.Milliseconds())
+	return nil
+}
+
+func (s *sqlitestorage) close() error {
+	return s.db.Close()
+}
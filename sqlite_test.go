@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestSqliteJournalModes(t *testing.T) {
+	for _, mode := range sqliteJournalModes {
+		cfg := conformanceConfig
+		cfg.dir = t.TempDir()
+		s, err := newSqlite(cfg, mode, 0)
+		if err != nil {
+			t.Errorf("%s: %v", mode, err)
+			continue
+		}
+		if err := s.close(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	cfg := conformanceConfig
+	cfg.dir = t.TempDir()
+	if _, err := newSqlite(cfg, "wall", 0); err == nil {
+		t.Error("an unknown journal mode should be rejected")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// topK keeps the k outputs with the highest propensities added to it. It's a min-heap
+// so the worst of the current best k is at the root and can be replaced in O(log k).
+type topK struct {
+	k int
+	h outputHeap
+}
+
+// newTopK makes a topK of the best k of at most n outputs, n only sizes the heap
+// so it's not allocated for a k that is larger than the dataset
+func newTopK(k int, n int) *topK {
+	if k < 0 {
+		k = 0
+	}
+	if n < 0 {
+		n = 0
+	}
+	return &topK{k: k, h: make(outputHeap, 0, minInt(k, n))}
+}
+
+func (t *topK) add(o output) {
+	if len(t.h) < t.k {
+		heap.Push(&t.h, o)
+	} else if t.k > 0 && worse(t.h[0], o) {
+		t.h[0] = o
+		heap.Fix(&t.h, 0)
+	}
+}
+
+// sorted returns the outputs best first, the topK can't be used afterwards
+func (t *topK) sorted() []output {
+	vs := []output(t.h)
+	sort.Slice(vs, func(i, j int) bool { return worse(vs[j], vs[i]) })
+	t.h = nil
+	return vs
+}
+
+// topMembersByStream keeps the best k of the streamed propensities of movie, so
+// only k outputs are in memory however many members there are. members is the
+// expected number of members, see newTopK.
+func topMembersByStream(s storage, movie uint32, k int, members int) ([]output, error) {
+	top := newTopK(k, members)
+	err := s.streamPropensities(movie, func(batch []output) error {
+		for _, o := range batch {
+			top.add(o)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return top.sorted(), nil
+}
+
+// worse orders outputs by propensity, ties are broken by preferring lower ids so
+// every backend returns the same top k
+func worse(a, b output) bool {
+	if a.propensity != b.propensity {
+		return a.propensity < b.propensity
+	}
+	if a.movie != b.movie {
+		return a.movie > b.movie
+	}
+	return a.member > b.member
+}
+
+// outputHeap implements heap.Interface with the worst output at the root
+type outputHeap []output
+
+func (h outputHeap) Len() int            { return len(h) }
+func (h outputHeap) Less(i, j int) bool  { return worse(h[i], h[j]) }
+func (h outputHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *outputHeap) Push(x interface{}) { *h = append(*h, x.(output)) }
+
+func (h *outputHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
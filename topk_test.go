@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestTopK(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	outputs := make([]output, 1000)
+	for i := range outputs {
+		// few distinct propensities so ties have to be broken by id
+		outputs[i] = output{member: uint32(i), propensity: float64(r.Intn(50))}
+	}
+	expected := append([]output(nil), outputs...)
+	sort.Slice(expected, func(i, j int) bool { return worse(expected[j], expected[i]) })
+
+	for _, k := range []int{0, 1, 10, 999, 1000, 2000} {
+		top := newTopK(k, len(outputs))
+		for _, o := range outputs {
+			top.add(o)
+		}
+		actual := top.sorted()
+		n := minInt(k, len(expected))
+		if !reflect.DeepEqual(actual, expected[:n]) && !(n == 0 && len(actual) == 0) {
+			t.Errorf("k=%d: got %v, expected %v", k, actual, expected[:n])
+		}
+	}
+}
+
+func TestWorse(t *testing.T) {
+	if !worse(output{propensity: 1}, output{propensity: 2}) {
+		t.Error("a lower propensity should be worse")
+	}
+	if !worse(output{movie: 2, propensity: 1}, output{movie: 1, propensity: 1}) {
+		t.Error("a higher movie id should be worse in a tie")
+	}
+	if !worse(output{member: 2, propensity: 1}, output{member: 1, propensity: 1}) {
+		t.Error("a higher member id should be worse in a tie")
+	}
+}
+
+// k is only limited by the dataset, so a huge k mustn't be allocated up front
+func TestTopKHugeK(t *testing.T) {
+	top := newTopK(1<<40, 3)
+	for i := 0; i < 3; i++ {
+		top.add(output{member: uint32(i), propensity: float64(i)})
+	}
+	if vs := top.sorted(); len(vs) != 3 || vs[0].member != 2 {
+		t.Errorf("expected all 3 outputs best first, got %v", vs)
+	}
+}
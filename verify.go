@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Maximum number of mismatching outputs printed per backend and workload
+const MAX_REPORTED_MISMATCHES = 10
+
+// referencestorage computes every output directly from the generator, so it's
+// correct by construction as long as the backends were loaded with the same seed.
+// Like pg, ids that aren't in the dataset are skipped.
+type referencestorage struct {
+	cfg config
+	gen generator
+}
+
+func newReference(cfg config) *referencestorage {
+	return &referencestorage{cfg, cfg.generator()}
+}
+
+func (*referencestorage) name() string {
+	return "reference"
+}
+
+func (s *referencestorage) getMember(id uint32) (vector, error) {
+	if int(id) >= s.cfg.members {
+		return nil, nil
+	}
+	return s.gen.member(id), nil
+}
+
+func (s *referencestorage) getMovie(id uint32) (vector, error) {
+	if int(id) >= s.cfg.movies {
+		return nil, nil
+	}
+	return s.gen.movie(id), nil
+}
+
+func (s *referencestorage) query(memberids []uint32, movieids []uint32) ([]output, error) {
+	return scorePerMovie(memberids, movieids, s.getMember, s.getMovie)
+}
+
+func (s *referencestorage) queryModel(memberids []uint32, models []MovieModel) ([]output, error) {
+	return scoreModels(memberids, models, s.getMember, s.getMovie)
+}
+
+func (s *referencestorage) queryRange(low uint32, high uint32, movieids []uint32) ([]output, error) {
+	n := rangeLen(low, high, s.cfg.members)
+	return s.query(makeRange(low, low+uint32(n)), movieids)
+}
+
+func (s *referencestorage) memberPropensities(movie uint32) ([]output, error) {
+	w, _ := s.getMovie(movie)
+	if w == nil {
+		return nil, nil
+	}
+	vs := make([]output, 0, s.cfg.members)
+	for member := 0; member < s.cfg.members; member++ {
+		vs = append(vs, output{uint32(member), movie, s.gen.member(uint32(member)).dot(w)})
+	}
+	return vs, nil
+}
+
+func (s *referencestorage) streamPropensities(movie uint32, f func([]output) error) error {
+	w, _ := s.getMovie(movie)
+	if w == nil {
+		return nil
+	}
+	b := newBatcher(f)
+	for member := 0; member < s.cfg.members; member++ {
+		if err := b.add(output{uint32(member), movie, s.gen.member(uint32(member)).dot(w)}); err != nil {
+			return err
+		}
+	}
+	return b.flush()
+}
+
+func (s *referencestorage) topMembers(movie uint32, k int) ([]output, error) {
+	return topMembersByStream(s, movie, k, s.cfg.members)
+}
+
+func (s *referencestorage) topMovies(member uint32, k int) ([]output, error) {
+	v, _ := s.getMember(member)
+	if v == nil {
+		return nil, nil
+	}
+	top := newTopK(k, s.cfg.movies)
+	for movie := 0; movie < s.cfg.movies; movie++ {
+		top.add(output{member, uint32(movie), v.dot(s.gen.movie(uint32(movie)))})
+	}
+	return top.sorted(), nil
+}
+
+func (s *referencestorage) scanMembers(f func(id uint32, v vector) error) error {
+	for member := 0; member < s.cfg.members; member++ {
+		if err := f(uint32(member), s.gen.member(uint32(member))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (*referencestorage) insertRandomMembers(n int) error {
+	return nil
+}
+
+func (*referencestorage) insertRandomMovies(n int) error {
+	return nil
+}
+
+func (*referencestorage) close() error {
+	return nil
+}
+
+func runVerify(args []string) error {
+	opts, err := parseOptions("verify", args)
+	if err != nil {
+		return err
+	}
+
+	// the reference outputs are computed once up front rather than per backend
+	reference := newReference(opts.config)
+	expected := make([][]output, len(opts.workloads))
+	for i, w := range opts.workloads {
+		if expected[i], err = w.query(reference, opts.config); err != nil {
+			return err
+		}
+	}
+
+	failures := 0
+	err = withBackends(opts, func(backend storage) error {
+		for i, w := range opts.workloads {
+			actual, err := w.query(backend, opts.config)
+			if err != nil {
+				return fmt.Errorf("%s %s: %v", backend.name(), w.name, err)
+			}
+			mismatches := diffOutputs(expected[i], actual, opts.tolerance)
+			if len(mismatches) == 0 {
+				fmt.Printf("%-8s %-14s ok (%d results)\n", backend.name(), w.name, len(actual))
+				continue
+			}
+
+			failures++
+			fmt.Printf("%-8s %-14s %d mismatches in %d results, expected %d results\n",
+				backend.name(), w.name, len(mismatches), len(actual), len(expected[i]))
+			for j, m := range mismatches {
+				if j == MAX_REPORTED_MISMATCHES {
+					fmt.Printf("  ... %d more\n", len(mismatches)-j)
+					break
+				}
+				fmt.Printf("  %s\n", m)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("%d backend workload(s) didn't match the reference", failures)
+	}
+	return nil
+}
+
+type mismatch struct {
+	member   uint32
+	movie    uint32
+	expected float64
+	actual   float64
+	// false if the output is missing from one side
+	hasExpected bool
+	hasActual   bool
+}
+
+func (m mismatch) String() string {
+	switch {
+	case !m.hasActual:
+		return fmt.Sprintf("member %d movie %d: missing, expected %g", m.member, m.movie, m.expected)
+	case !m.hasExpected:
+		return fmt.Sprintf("member %d movie %d: unexpected result %g", m.member, m.movie, m.actual)
+	default:
+		return fmt.Sprintf("member %d movie %d: expected %g, got %g", m.member, m.movie, m.expected, m.actual)
+	}
+}
+
+// diffOutputs compares outputs regardless of order. Model queries return several
+// outputs per member with the same movie id so propensities are compared in sorted
+// order within each (member, movie) pair.
+func diffOutputs(expected, actual []output, tolerance float64) []mismatch {
+	type key struct{ member, movie uint32 }
+	group := func(outputs []output) map[key][]float64 {
+		groups := make(map[key][]float64)
+		for _, o := range outputs {
+			k := key{o.member, o.movie}
+			groups[k] = append(groups[k], o.propensity)
+		}
+		for _, ps := range groups {
+			sort.Float64s(ps)
+		}
+		return groups
+	}
+	expectedGroups := group(expected)
+	actualGroups := group(actual)
+
+	var mismatches []mismatch
+	for k, es := range expectedGroups {
+		as := actualGroups[k]
+		for i := 0; i < len(es) || i < len(as); i++ {
+			m := mismatch{member: k.member, movie: k.movie, hasExpected: i < len(es), hasActual: i < len(as)}
+			if m.hasExpected {
+				m.expected = es[i]
+			}
+			if m.hasActual {
+				m.actual = as[i]
+			}
+			if !m.hasExpected || !m.hasActual || !approxEqual(m.expected, m.actual, tolerance) {
+				mismatches = append(mismatches, m)
+			}
+		}
+	}
+	for k, as := range actualGroups {
+		if _, ok := expectedGroups[k]; ok {
+			continue
+		}
+		for _, a := range as {
+			mismatches = append(mismatches, mismatch{member: k.member, movie: k.movie, actual: a, hasActual: true})
+		}
+	}
+
+	sort.Slice(mismatches, func(i, j int) bool {
+		if mismatches[i].member != mismatches[j].member {
+			return mismatches[i].member < mismatches[j].member
+		}
+		return mismatches[i].movie < mismatches[j].movie
+	})
+	return mismatches
+}
+
+// approxEqual compares relative to the magnitude of the values, or absolutely near 0
+func approxEqual(a, b, tolerance float64) bool {
+	if a == b || (math.IsNaN(a) && math.IsNaN(b)) {
+		return true
+	}
+	scale := math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+	return math.Abs(a-b) <= tolerance*scale
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestDiffOutputs(t *testing.T) {
+	expected := []output{
+		{1, 1, 0.5},
+		{1, 2, 0.25},
+		// two models for the same member
+		{2, 7, 0.1},
+		{2, 7, 0.2},
+		{3, 1, 1},
+	}
+	actual := []output{
+		{2, 7, 0.2},
+		{1, 2, 0.25 + 1e-12},
+		{2, 7, 0.1},
+		{1, 1, 0.75},
+		{4, 1, 1},
+	}
+
+	mismatches := diffOutputs(expected, actual, 1e-9)
+	want := []mismatch{
+		{member: 1, movie: 1, expected: 0.5, actual: 0.75, hasExpected: true, hasActual: true},
+		{member: 3, movie: 1, expected: 1, hasExpected: true},
+		{member: 4, movie: 1, actual: 1, hasActual: true},
+	}
+	if len(mismatches) != len(want) {
+		t.Fatalf("expected %d mismatches, got %v", len(want), mismatches)
+	}
+	for i := range want {
+		if mismatches[i] != want[i] {
+			t.Errorf("expected %v, got %v", want[i], mismatches[i])
+		}
+	}
+
+	if mismatches := diffOutputs(expected, expected, 0); len(mismatches) != 0 {
+		t.Errorf("expected no mismatches, got %v", mismatches)
+	}
+}